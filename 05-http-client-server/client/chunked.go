@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var errBadChunk = errors.New("malformed chunked encoding")
+
+// chunkedReader decodes a chunked body (RFC 9112, 7.1), as servers
+// send when they don't know the length up front, returning io.EOF
+// after the last chunk. Chunk extensions are skipped. Once the body is read
+// trailer holds the trailer fields as "Name: value" lines.
+type chunkedReader struct {
+	r       *bufio.Reader
+	left    int64 // bytes of the current chunk not yet read
+	started bool  // a chunk was read, so its CRLF comes first
+	trailer []string
+	err     error // sticky, io.EOF once the body is done
+}
+
+func newChunkedReader(r *bufio.Reader) *chunkedReader {
+	return &chunkedReader{r: r}
+}
+
+func (cr *chunkedReader) Read(p []byte) (int, error) {
+	for cr.left == 0 && cr.err == nil {
+		cr.err = cr.nextChunk()
+	}
+	if cr.err != nil {
+		return 0, cr.err
+	}
+	n, err := cr.r.Read(p[:min(int64(len(p)), cr.left)])
+	cr.left -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		cr.err = err
+	}
+	return n, err
+}
+
+// nextChunk reads up to the data of the next chunk, or through the
+// trailer after the last one.
+func (cr *chunkedReader) nextChunk() error {
+	if cr.started {
+		if line, err := readChunkLine(cr.r); err != nil || line != "" {
+			return cmp.Or(err, errBadChunk)
+		}
+	}
+	cr.started = true
+
+	line, err := readChunkLine(cr.r)
+	if err != nil {
+		return err
+	}
+	size, _, _ := strings.Cut(line, ";")
+	size = strings.TrimRight(size, " \t")
+	if size == "" || strings.Trim(size, "0123456789abcdefABCDEF") != "" {
+		return errBadChunk
+	}
+	n, err := strconv.ParseInt(size, 16, 64)
+	if err != nil {
+		return errBadChunk
+	}
+	if n > 0 {
+		cr.left = n
+		return nil
+	}
+
+	for {
+		line, err := readChunkLine(cr.r)
+		if err != nil {
+			return err
+		}
+		if line == "" {
+			return io.EOF
+		}
+		if !strings.Contains(line, ":") {
+			return errBadChunk
+		}
+		cr.trailer = append(cr.trailer, line)
+	}
+}
+
+// readChunkLine returns one line without its CRLF (or bare LF).
+// Running out of input means the body was cut short.
+func readChunkLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimSuffix(line, "\n")
+	return strings.TrimSuffix(line, "\r"), nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http/httputil"
+	"slices"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// oneByte reads s a byte at a time, so that every chunk boundary
+// falls between two reads.
+func oneByte(s string) *bufio.Reader {
+	return bufio.NewReaderSize(iotest.OneByteReader(strings.NewReader(s)), 16)
+}
+
+func TestChunkedReader(t *testing.T) {
+	testcases := []struct {
+		name    string
+		body    string
+		want    string
+		trailer []string
+		wantErr bool
+	}{
+		{name: "two chunks", body: "3\r\nabc\r\n2\r\nde\r\n0\r\n\r\n", want: "abcde"},
+		{name: "extensions", body: "a;x=y\r\n0123456789\r\n0;z\r\n\r\n", want: "0123456789"},
+		{name: "trailer", body: "2\r\nok\r\n0\r\nServer-Timing: cgi;dur=3\r\n\r\n", want: "ok", trailer: []string{"Server-Timing: cgi;dur=3"}},
+		{name: "bad size", body: "-2\r\nok\r\n0\r\n\r\n", wantErr: true},
+		{name: "data overruns size", body: "1\r\nok\r\n0\r\n\r\n", wantErr: true},
+		{name: "no last chunk", body: "2\r\nok\r\n", wantErr: true},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			cr := newChunkedReader(oneByte(tc.body))
+			got, err := io.ReadAll(cr)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("Expected error, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if string(got) != tc.want || !slices.Equal(cr.trailer, tc.trailer) {
+				t.Errorf("Got %q %q, want %q %q", got, cr.trailer, tc.want, tc.trailer)
+			}
+		})
+	}
+}
+
+func TestChunkedReaderMatchesNetHTTP(t *testing.T) {
+	var b bytes.Buffer
+	cw := httputil.NewChunkedWriter(&b)
+	body := strings.Repeat("chunk me ", 1000)
+	for i := 0; i < len(body); i += 333 {
+		cw.Write([]byte(body[i:min(i+333, len(body))]))
+	}
+	cw.Close()
+	b.WriteString("\r\n") // net/http leaves the trailer section to the caller
+
+	got, err := io.ReadAll(newChunkedReader(oneByte(b.String())))
+	if err != nil || string(got) != body {
+		t.Errorf("Got %d bytes, %v; want %d", len(got), err, len(body))
+	}
+}
+
+func TestReadResponse(t *testing.T) {
+	head := "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nTransfer-Encoding: chunked\r\n\r\n"
+	var out bytes.Buffer
+	trailer, err := readResponse(oneByte(head+"4\r\none\n\r\n4\r\ntwo\n\r\n0\r\nX-Done: yes\r\n\r\n"), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != head+"one\ntwo\n" || !slices.Equal(trailer, []string{"X-Done: yes"}) {
+		t.Errorf("Got %q, trailer %q", out.String(), trailer)
+	}
+
+	out.Reset()
+	plain := "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello"
+	if _, err := readResponse(oneByte(plain), &out); err != nil || out.String() != plain {
+		t.Errorf("Got %q, %v", out.String(), err)
+	}
+
+	if _, err := readResponse(oneByte(head+"4\r\none\n\r\n"), io.Discard); err == nil {
+		t.Error("Expected an error for a body without its last chunk")
+	}
+}
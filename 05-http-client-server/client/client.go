@@ -1,19 +1,35 @@
 package main
 
 import (
+	"bufio"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"os"
+	"strings"
 )
 
 func main() {
 	host := flag.String("host", "localhost", "address to send request")
 	port := flag.String("port", "8080", "port to send request")
+	path := flag.String("path", "/", "`path` to GET")
+	ws := flag.String("ws", "", "open a WebSocket to this `path` instead, sending stdin lines and printing what arrives")
+	events := flag.String("events", "", "follow the Server-Sent Events stream at this `path` instead, printing each event")
 	flag.Parse()
 
 	addr := net.JoinHostPort(*host, *port)
+	if *ws != "" {
+		if err := chat(addr, *host, *ws); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if *events != "" {
+		followEvents(addr, *host, *events)
+		return
+	}
 	conn, err := net.Dial("tcp", addr)
 	if err != nil {
 		log.Fatalf("Error connecting: %v", err)
@@ -21,14 +37,15 @@ func main() {
 	defer conn.Close()
 
 	// write request
+	payload := "Hello!\r\n"
 	request := fmt.Sprintf(
-		"GET / HTTP/1.1\r\n"+
+		"GET %s HTTP/1.1\r\n"+
 			"Host: %s\r\n"+
 			"Connection: close\r\n"+
 			"Content-Type: text/plain\r\n"+
-			"\r\n"+
-			"Hello!\r\n",
-		*host,
+			"Content-Length: %d\r\n"+
+			"\r\n"+payload,
+		*path, *host, len(payload),
 	)
 	_, err = conn.Write([]byte(request))
 	if err != nil {
@@ -41,10 +58,46 @@ func main() {
 	}
 
 	// read response
-	resp, err := io.ReadAll(conn)
+	trailer, err := readResponse(bufio.NewReader(conn), os.Stdout)
 	if err != nil {
 		log.Fatal(err)
 	}
+	for _, f := range trailer {
+		log.Printf("Trailer %s", f)
+	}
+}
+
+// readResponse copies a response to w as it arrives, the head as sent
+// and the body decoded if it is chunked, and returns the trailer
+// fields of a chunked body.
+func readResponse(r *bufio.Reader, w io.Writer) (trailer []string, err error) {
+	chunked := false
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(w, line); err != nil {
+			return nil, err
+		}
+		if line == "\r\n" || line == "\n" {
+			break
+		}
+		name, value, _ := strings.Cut(line, ":")
+		if strings.EqualFold(strings.TrimSpace(name), "Transfer-Encoding") {
+			// chunked must be the final coding
+			codings := strings.Split(value, ",")
+			chunked = strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked")
+		}
+	}
 
-	fmt.Printf("%s", resp)
+	if !chunked {
+		_, err := io.Copy(w, r)
+		return nil, err
+	}
+	cr := newChunkedReader(r)
+	if _, err := io.Copy(w, cr); err != nil {
+		return nil, fmt.Errorf("reading chunked body: %w", err)
+	}
+	return cr.trailer, nil
 }
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sseEvent is one event read from a text/event-stream.
+type sseEvent struct {
+	id, typ, data string
+}
+
+// followEvents prints the events streamed at path until interrupted.
+// When the stream ends it reconnects after the server's retry hint,
+// sending Last-Event-ID so that no event is missed.
+func followEvents(addr, host, path string) {
+	lastID, retry := "", 3*time.Second
+	for {
+		err := readStream(addr, host, path, &lastID, &retry, func(ev sseEvent) {
+			fmt.Printf("id=%s event=%s data=%q\n", ev.id, ev.typ, ev.data)
+		})
+		log.Printf("Stream ended: %v; reconnecting in %v", err, retry)
+		time.Sleep(retry)
+	}
+}
+
+// readStream makes one request for the stream and passes events to
+// emit, keeping lastID and retry up to date for the next connection.
+func readStream(addr, host, path string, lastID *string, retry *time.Duration, emit func(sseEvent)) error {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	request := "GET " + path + " HTTP/1.1\r\n" +
+		"Host: " + host + "\r\n" +
+		"Accept: text/event-stream\r\n"
+	if *lastID != "" {
+		request += "Last-Event-ID: " + *lastID + "\r\n"
+	}
+	if _, err := conn.Write([]byte(request + "\r\n")); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(conn)
+	status, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if f := strings.Fields(status); len(f) < 2 || f[1] != "200" {
+		return fmt.Errorf("server answered %q", strings.TrimSpace(status))
+	}
+	for { // skip the header fields
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if line == "\r\n" || line == "\n" {
+			break
+		}
+	}
+	return parseEvents(r, lastID, retry, emit)
+}
+
+// parseEvents reads text/event-stream frames from r until it ends.
+// Fields follow the HTML Living Standard: data lines are joined with
+// newlines, comment lines starting with a colon are ignored and a
+// frame with no data dispatches nothing.
+func parseEvents(r io.Reader, lastID *string, retry *time.Duration, emit func(sseEvent)) error {
+	sc := bufio.NewScanner(r)
+	var ev sseEvent
+	var data []string
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" {
+			if data != nil {
+				ev.data = strings.Join(data, "\n")
+				ev.id = *lastID
+				if ev.typ == "" {
+					ev.typ = "message"
+				}
+				emit(ev)
+			}
+			ev, data = sseEvent{}, nil
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+		name, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch name {
+		case "id":
+			*lastID = value
+		case "event":
+			ev.typ = value
+		case "data":
+			data = append(data, value)
+		case "retry":
+			if ms, err := strconv.Atoi(value); err == nil && ms >= 0 {
+				*retry = time.Duration(ms) * time.Millisecond
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	return errors.New("end of stream")
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseEvents(t *testing.T) {
+	stream := "retry: 1500\n\n" +
+		": heartbeat\n\n" +
+		"id: 1\nevent: put\ndata: /up/a.txt\n\n" +
+		"data: one\ndata:two\n\n" +
+		"id: 3\nevent: delete\n\n" + // no data, not dispatched
+		"id: 4\nevent: put\ndata: /b\r\n\r\n"
+
+	var got []sseEvent
+	lastID, retry := "", time.Second
+	parseEvents(strings.NewReader(stream), &lastID, &retry, func(ev sseEvent) {
+		got = append(got, ev)
+	})
+
+	want := []sseEvent{
+		{"1", "put", "/up/a.txt"},
+		{"1", "message", "one\ntwo"},
+		{"4", "put", "/b"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Got %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Event %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+	if lastID != "4" || retry != 1500*time.Millisecond {
+		t.Errorf("Got last id %q retry %v, want 4 and 1.5s", lastID, retry)
+	}
+}
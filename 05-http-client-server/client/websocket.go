@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"unicode/utf8"
+)
+
+// The GUID every handshake appends to the client's key (RFC 6455, 1.3).
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Frame opcodes.
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+// Close status codes (RFC 6455, 7.4.1).
+const (
+	closeNormal        = 1000
+	closeGoingAway     = 1001
+	closeProtocolError = 1002
+	closeNoStatus      = 1005 // never sent, reported for an empty close
+	closeInvalidData   = 1007
+	closeTooBig        = 1009
+)
+
+// wsAccept computes Sec-WebSocket-Accept for a Sec-WebSocket-Key.
+func wsAccept(key string) string {
+	sum := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// wsConn speaks the framing protocol over an upgraded connection.
+// Clients mask every frame they send and servers none, so each side
+// checks the other did as told. Writes are serialized, as a broadcast
+// may write while the read loop answers a ping.
+type wsConn struct {
+	c          net.Conn
+	r          *bufio.Reader
+	client     bool
+	maxMessage int
+
+	wmu    sync.Mutex
+	closed bool // a close frame was sent
+}
+
+// wsCloseError reports the close frame that ended a connection, sent
+// by either side.
+type wsCloseError struct {
+	code   int
+	reason string
+}
+
+func (e *wsCloseError) Error() string {
+	return fmt.Sprintf("websocket closed: %d %s", e.code, e.reason)
+}
+
+type wsFrame struct {
+	fin     bool
+	op      byte
+	payload []byte
+}
+
+// readFrame reads one frame, unmasking its payload.
+func (ws *wsConn) readFrame() (wsFrame, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(ws.r, head[:]); err != nil {
+		return wsFrame{}, err
+	}
+	f := wsFrame{fin: head[0]&0x80 != 0, op: head[0] & 0x0F}
+	if head[0]&0x70 != 0 {
+		return f, &wsCloseError{closeProtocolError, "reserved bits set"}
+	}
+	masked := head[1]&0x80 != 0
+	if masked == ws.client {
+		return f, &wsCloseError{closeProtocolError, "wrong masking"}
+	}
+
+	n := uint64(head[1] & 0x7F)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(ws.r, ext[:]); err != nil {
+			return f, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(ws.r, ext[:]); err != nil {
+			return f, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if f.op >= opClose && (n > 125 || !f.fin) {
+		return f, &wsCloseError{closeProtocolError, "bad control frame"}
+	}
+	if n > uint64(ws.maxMessage) {
+		return f, &wsCloseError{closeTooBig, "frame too big"}
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(ws.r, mask[:]); err != nil {
+			return f, err
+		}
+	}
+	f.payload = make([]byte, n)
+	if _, err := io.ReadFull(ws.r, f.payload); err != nil {
+		return f, err
+	}
+	if masked {
+		for i := range f.payload {
+			f.payload[i] ^= mask[i%4]
+		}
+	}
+	return f, nil
+}
+
+// writeFrame sends a single final frame.
+func (ws *wsConn) writeFrame(op byte, payload []byte) error {
+	ws.wmu.Lock()
+	defer ws.wmu.Unlock()
+	if ws.closed {
+		return net.ErrClosed
+	}
+	if op == opClose {
+		ws.closed = true
+	}
+
+	frame := []byte{0x80 | op}
+	var maskBit byte
+	if ws.client {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n <= 125:
+		frame = append(frame, maskBit|byte(n))
+	case n <= 0xFFFF:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	if ws.client {
+		var mask [4]byte
+		rand.Read(mask[:])
+		frame = append(frame, mask[:]...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		for i := range payload {
+			frame[start+i] ^= mask[i%4]
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+	_, err := ws.c.Write(frame)
+	return err
+}
+
+// readMessage returns the next text or binary message, joining its
+// fragments. Pings are answered along the way. When the peer closes,
+// or breaks the protocol, the close is answered and reported as a
+// *wsCloseError.
+func (ws *wsConn) readMessage() (op byte, data []byte, err error) {
+	for {
+		f, err := ws.readFrame()
+		var ce *wsCloseError
+		if errors.As(err, &ce) {
+			ws.close(ce.code, ce.reason)
+			return 0, nil, ce
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch f.op {
+		case opPing:
+			ws.writeFrame(opPong, f.payload)
+			continue
+		case opPong:
+			continue
+		case opClose:
+			ce := parseClose(f.payload)
+			code := ce.code
+			if code == closeNoStatus {
+				code = closeNormal
+			}
+			ws.close(code, "")
+			return 0, nil, ce
+		case opText, opBinary:
+			if op != 0 {
+				return ws.fail(closeProtocolError, "new message inside a fragmented one")
+			}
+			op = f.op
+		case opContinuation:
+			if op == 0 {
+				return ws.fail(closeProtocolError, "continuation without a message")
+			}
+		default:
+			return ws.fail(closeProtocolError, "unknown opcode")
+		}
+
+		if len(data)+len(f.payload) > ws.maxMessage {
+			return ws.fail(closeTooBig, "message too big")
+		}
+		data = append(data, f.payload...)
+		if f.fin {
+			if op == opText && !utf8.Valid(data) {
+				return ws.fail(closeInvalidData, "text is not UTF-8")
+			}
+			return op, data, nil
+		}
+	}
+}
+
+func (ws *wsConn) fail(code int, reason string) (byte, []byte, error) {
+	ws.close(code, reason)
+	return 0, nil, &wsCloseError{code, reason}
+}
+
+// parseClose reads the status code and reason of a close frame. A
+// malformed one counts as a protocol error.
+func parseClose(payload []byte) *wsCloseError {
+	switch {
+	case len(payload) == 0:
+		return &wsCloseError{code: closeNoStatus}
+	case len(payload) == 1:
+		return &wsCloseError{closeProtocolError, "truncated close code"}
+	}
+	code := int(binary.BigEndian.Uint16(payload))
+	reason := payload[2:]
+	if !validCloseCode(code) {
+		return &wsCloseError{closeProtocolError, "invalid close code"}
+	}
+	if !utf8.Valid(reason) {
+		return &wsCloseError{closeInvalidData, "close reason is not UTF-8"}
+	}
+	return &wsCloseError{code, string(reason)}
+}
+
+// validCloseCode reports whether a peer may send code: the ones
+// defined for use on the wire, and those for libraries and
+// applications.
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1011:
+		return true
+	}
+	return code >= 3000 && code <= 4999
+}
+
+// close sends a close frame unless one was sent already.
+func (ws *wsConn) close(code int, reason string) error {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	payload = append(payload, reason...)
+	if len(payload) > 125 {
+		payload = payload[:125]
+	}
+	return ws.writeFrame(opClose, payload)
+}
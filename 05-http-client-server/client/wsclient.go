@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// dialWebSocket performs the client side of the opening handshake.
+func dialWebSocket(addr, host, path string) (*wsConn, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	var nonce [16]byte
+	rand.Read(nonce[:])
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+
+	request := "GET " + path + " HTTP/1.1\r\n" +
+		"Host: " + host + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Version: 13\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\n\r\n"
+	if _, err := conn.Write([]byte(request)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	status, err := r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if f := strings.Fields(status); len(f) < 2 || f[1] != "101" {
+		conn.Close()
+		return nil, fmt.Errorf("server answered %q", strings.TrimSpace(status))
+	}
+	accepted := false
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		name, value, _ := strings.Cut(line, ":")
+		if strings.EqualFold(name, "Sec-WebSocket-Accept") {
+			accepted = strings.TrimSpace(value) == wsAccept(key)
+		}
+	}
+	if !accepted {
+		conn.Close()
+		return nil, errors.New("missing or wrong Sec-WebSocket-Accept")
+	}
+	return &wsConn{c: conn, r: r, client: true, maxMessage: 1 << 20}, nil
+}
+
+// chat sends each line of stdin as a text message and prints every
+// message that arrives. At the end of stdin it closes normally and
+// waits for the server to answer the close.
+func chat(addr, host, path string) error {
+	ws, err := dialWebSocket(addr, host, path)
+	if err != nil {
+		return err
+	}
+	defer ws.c.Close()
+
+	go func() {
+		sc := bufio.NewScanner(os.Stdin)
+		for sc.Scan() {
+			if err := ws.writeFrame(opText, sc.Bytes()); err != nil {
+				return
+			}
+		}
+		ws.close(closeNormal, "")
+	}()
+
+	for {
+		op, data, err := ws.readMessage()
+		var ce *wsCloseError
+		if errors.As(err, &ce) {
+			if ce.code == closeNormal || ce.code == closeNoStatus {
+				return nil
+			}
+			return ce
+		}
+		if err != nil {
+			return err
+		}
+		if op == opText {
+			fmt.Printf("< %s\n", data)
+		} else {
+			fmt.Printf("< %d bytes of binary\n", len(data))
+		}
+	}
+}
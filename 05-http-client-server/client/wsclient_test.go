@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+)
+
+// echoServer accepts one WebSocket and echoes its messages, using the
+// server side of wsConn.
+func echoServer(t *testing.T, accept func(key string) string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		r := bufio.NewReader(c)
+		var key string
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if line == "\r\n" {
+				break
+			}
+			if name, value, _ := strings.Cut(line, ":"); name == "Sec-WebSocket-Key" {
+				key = strings.TrimSpace(value)
+			}
+		}
+		c.Write([]byte("HTTP/1.1 101 Switching Protocols\r\n" +
+			"Upgrade: websocket\r\nConnection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: " + accept(key) + "\r\n\r\n"))
+		ws := &wsConn{c: c, r: r, maxMessage: 1 << 20}
+		for {
+			op, data, err := ws.readMessage()
+			if err != nil {
+				return
+			}
+			ws.writeFrame(op, data)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestDialWebSocket(t *testing.T) {
+	ws, err := dialWebSocket(echoServer(t, wsAccept), "test", "/ws/echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.c.Close()
+
+	msg := strings.Repeat("x", 70000) // 64 bit length
+	ws.writeFrame(opText, []byte(msg))
+	if op, data, err := ws.readMessage(); err != nil || op != opText || string(data) != msg {
+		t.Errorf("Got op %d, %d bytes, %v", op, len(data), err)
+	}
+	ws.close(closeNormal, "")
+	if _, _, err := ws.readMessage(); err == nil || !strings.Contains(err.Error(), "1000") {
+		t.Errorf("Got %v, want the close answered", err)
+	}
+}
+
+func TestDialWebSocketBadAccept(t *testing.T) {
+	addr := echoServer(t, func(string) string { return "bogus" })
+	if _, err := dialWebSocket(addr, "test", "/"); err == nil {
+		t.Error("Accepted a wrong Sec-WebSocket-Accept")
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metrics counts what the server does, for scraping in the Prometheus
+// text format.
+type metrics struct {
+	mu       sync.Mutex
+	requests map[[2]string]int64 // {method, code} -> count
+	buckets  []int64             // per latencyBuckets, plus +Inf
+	latSum   float64
+	latCount int64
+
+	bytesIn      atomic.Int64
+	bytesOut     atomic.Int64
+	active       atomic.Int64
+	acceptErrors atomic.Int64
+}
+
+// Upper bounds in seconds of the latency histogram buckets.
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Methods outside this set are counted as OTHER so that a client
+// can't grow the label set at will.
+var knownMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "DELETE": true,
+	"OPTIONS": true, "PATCH": true,
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests: make(map[[2]string]int64),
+		buckets:  make([]int64, len(latencyBuckets)+1),
+	}
+}
+
+// meteredConn counts the bytes through a connection and picks the
+// method out of the first request line read and the status code out
+// of the first status line written.
+type meteredConn struct {
+	net.Conn
+	m     *metrics
+	start time.Time
+
+	in, out  int64
+	readHead []byte // start of the request, until the method is known
+	method   string
+	code     string
+}
+
+func (m *metrics) track(c net.Conn) *meteredConn {
+	m.active.Add(1)
+	return &meteredConn{Conn: c, m: m, start: time.Now()}
+}
+
+func (mc *meteredConn) Read(p []byte) (int, error) {
+	n, err := mc.Conn.Read(p)
+	mc.in += int64(n)
+	if mc.method == "" && len(mc.readHead) < 16 {
+		mc.readHead = append(mc.readHead, p[:n]...)
+		if method, _, ok := bytes.Cut(mc.readHead, []byte(" ")); ok {
+			mc.method = string(method)
+		}
+	}
+	return n, err
+}
+
+func (mc *meteredConn) Write(p []byte) (int, error) {
+	if mc.code == "" && mc.out == 0 {
+		// "HTTP/1.1 200 OK", the first write carries the status line
+		if fields := strings.Fields(string(p[:min(len(p), 16)])); len(fields) > 1 {
+			mc.code = fields[1]
+		}
+	}
+	n, err := mc.Conn.Write(p)
+	mc.out += int64(n)
+	return n, err
+}
+
+// CloseWrite passes a half close through to the TCP connection.
+func (mc *meteredConn) CloseWrite() error {
+	if cw, ok := mc.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// done records the finished connection.
+func (mc *meteredConn) done() {
+	m := mc.m
+	m.active.Add(-1)
+	m.bytesIn.Add(mc.in)
+	m.bytesOut.Add(mc.out)
+	if mc.code == "" {
+		return // nothing was answered
+	}
+
+	method := mc.method
+	if !knownMethods[method] {
+		method = "OTHER"
+	}
+	elapsed := time.Since(mc.start).Seconds()
+	i, _ := slices.BinarySearch(latencyBuckets, elapsed)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[[2]string{method, mc.code}]++
+	m.buckets[i]++
+	m.latSum += elapsed
+	m.latCount++
+}
+
+// writeTo renders all metrics in the Prometheus text format.
+func (m *metrics) writeTo(w io.Writer) {
+	m.mu.Lock()
+	requests := maps.Clone(m.requests)
+	buckets := slices.Clone(m.buckets)
+	latSum, latCount := m.latSum, m.latCount
+	m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP http_requests_total Requests answered, by method and status code.")
+	fmt.Fprintln(w, "# TYPE http_requests_total counter")
+	keys := slices.SortedFunc(maps.Keys(requests), func(a, b [2]string) int {
+		return strings.Compare(a[0]+a[1], b[0]+b[1])
+	})
+	for _, k := range keys {
+		fmt.Fprintf(w, "http_requests_total{method=%q,code=%q} %d\n", k[0], k[1], requests[k])
+	}
+
+	fmt.Fprintln(w, "# HELP http_request_duration_seconds Time from accepting a connection to closing it.")
+	fmt.Fprintln(w, "# TYPE http_request_duration_seconds histogram")
+	var cumulative int64
+	for i, le := range latencyBuckets {
+		cumulative += buckets[i]
+		fmt.Fprintf(w, "http_request_duration_seconds_bucket{le=\"%s\"} %d\n",
+			strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+	}
+	cumulative += buckets[len(latencyBuckets)]
+	fmt.Fprintf(w, "http_request_duration_seconds_bucket{le=\"+Inf\"} %d\n", cumulative)
+	fmt.Fprintf(w, "http_request_duration_seconds_sum %g\n", latSum)
+	fmt.Fprintf(w, "http_request_duration_seconds_count %d\n", latCount)
+
+	counter := func(name, help string, v int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, v)
+	}
+	counter("http_received_bytes_total", "Bytes read from clients.", m.bytesIn.Load())
+	counter("http_sent_bytes_total", "Bytes written to clients.", m.bytesOut.Load())
+	counter("http_accept_errors_total", "Failed listener accepts.", m.acceptErrors.Load())
+
+	fmt.Fprintln(w, "# HELP http_active_connections Connections being served.")
+	fmt.Fprintln(w, "# TYPE http_active_connections gauge")
+	fmt.Fprintf(w, "http_active_connections %d\n", m.active.Load())
+}
+
+// sendMetrics answers a scrape.
+func sendMetrics(c net.Conn) {
+	var body bytes.Buffer
+	stats.writeTo(&body)
+	fmt.Fprintf(c, "HTTP/1.1 200 OK\r\n"+
+		"Content-Type: text/plain; version=0.0.4\r\n"+
+		"Content-Length: %d\r\n"+
+		"Connection: close\r\n\r\n", body.Len())
+	body.WriteTo(c)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startServer serves handleConn on loopback, with metrics at /metrics
+// when withMetrics is set. The metrics settings are package globals,
+// so they are put back only once every connection is done with them.
+func startServer(t *testing.T, withMetrics bool) string {
+	t.Helper()
+	if withMetrics {
+		stats, metricsPath = newMetrics(), "/metrics"
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		ln.Close()
+		wg.Wait()
+		stats, metricsPath = nil, ""
+	})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				handleConn(c)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// send writes raw without closing its side, as requests are framed by
+// Content-Length, and returns the whole response.
+func send(t *testing.T, addr, raw string) string {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(2 * time.Second))
+	c.Write([]byte(raw))
+	resp, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatalf("Reading the response to %q: %v", raw, err)
+	}
+	return string(resp)
+}
+
+func TestMetrics(t *testing.T) {
+	addr := startServer(t, true)
+
+	send(t, addr, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+	send(t, addr, "POST /echo HTTP/1.1\r\nHost: test\r\nContent-Length: 5\r\n\r\nhello")
+	send(t, addr, "BREW /pot HTTP/1.1\r\nHost: test\r\n\r\n")
+
+	// Connections are recorded once closed, which may trail the
+	// client seeing the end of the response.
+	var resp string
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		resp = send(t, addr, "GET /metrics HTTP/1.1\r\nHost: test\r\n\r\n")
+		if strings.Contains(resp, "http_request_duration_seconds_count 3\n") || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if !strings.Contains(resp, "Content-Type: text/plain; version=0.0.4\r\n") {
+		t.Errorf("No Prometheus Content-Type in %q", resp)
+	}
+	for _, want := range []string{
+		`http_requests_total{method="GET",code="200"} 1`,
+		`http_requests_total{method="POST",code="200"} 1`,
+		`http_requests_total{method="OTHER",code="200"} 1`,
+		`http_request_duration_seconds_bucket{le="+Inf"} 3`,
+		"http_request_duration_seconds_count 3",
+		"http_active_connections 1", // the scrape itself
+		"http_accept_errors_total 0",
+		"# TYPE http_sent_bytes_total counter",
+	} {
+		if !strings.Contains(resp, want+"\n") {
+			t.Errorf("Missing %q in\n%s", want, resp)
+		}
+	}
+	if strings.Contains(resp, "http_received_bytes_total 0\n") || strings.Contains(resp, "http_sent_bytes_total 0\n") {
+		t.Errorf("No bytes counted in\n%s", resp)
+	}
+}
+
+func TestMetricsOff(t *testing.T) {
+	addr := startServer(t, false)
+
+	resp := send(t, addr, "GET /metrics HTTP/1.1\r\nHost: test\r\n\r\n")
+	if !strings.HasSuffix(resp, "\nHello from server!\n") {
+		t.Errorf("Got %q, want the usual greeting", resp)
+	}
+}
@@ -2,17 +2,30 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/textproto"
+	"strconv"
 	"strings"
 )
 
+// Set by -metrics; stats is nil when metrics are off.
+var (
+	stats       *metrics
+	metricsPath string
+)
+
 func main() {
 	port := flag.String("port", "28333", "port to listen request")
+	flag.StringVar(&metricsPath, "metrics", "", "serve Prometheus metrics at this `path`, e.g. /metrics; off when empty")
 	flag.Parse()
+	if metricsPath != "" {
+		stats = newMetrics()
+	}
 
 	listener, err := net.Listen("tcp", ":"+*port)
 	if err != nil {
@@ -22,6 +35,9 @@ func main() {
 		conn, err := listener.Accept()
 		if err != nil {
 			log.Print(err)
+			if stats != nil {
+				stats.acceptErrors.Add(1)
+			}
 			continue
 		}
 		go handleConn(conn)
@@ -30,9 +46,14 @@ func main() {
 
 // simple response for request
 func handleConn(c net.Conn) {
+	if stats != nil {
+		mc := stats.track(c)
+		defer mc.done()
+		c = mc
+	}
 	defer c.Close()
 
-	reqMethod, reqBody, err := parseReq(c)
+	reqMethod, reqTarget, reqBody, err := parseReq(c)
 	if err != nil {
 		log.Printf("Error parsing Request from %v: %v",
 			c.RemoteAddr().String(), err)
@@ -42,6 +63,11 @@ func handleConn(c net.Conn) {
 	log.Printf("Request from: %v\nMethod: %v\nBody: %v",
 		c.RemoteAddr().String(), reqMethod, reqBody)
 
+	if stats != nil && reqMethod == "GET" && reqTarget == metricsPath {
+		sendMetrics(c)
+		return
+	}
+
 	payload := "Hello from server!\n"
 	resp := fmt.Sprintf(
 		"HTTP/1.1 200 OK\n"+
@@ -54,28 +80,47 @@ func handleConn(c net.Conn) {
 	c.Write([]byte(resp))
 }
 
-// parseReq returns the method and payload of the request, nothing else.
-func parseReq(in io.Reader) (string, string, error) {
+var errBadRequest = errors.New("malformed request")
+
+// parseReq returns the method, target and payload of the request,
+// nothing else. The payload is Content-Length bytes long; without that
+// header there is none, so a client need not close its side first.
+func parseReq(in io.Reader) (method, target, body string, err error) {
 	reader := bufio.NewReader(in)
-	// Parse Request Line (Method)
+	// Parse Request Line (Method and Target)
 	line, err := reader.ReadString('\n')
 	if err != nil {
-		return "", "", err
+		return "", "", "", err
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return "", "", "", errBadRequest
 	}
-	method := strings.Fields(line)[0]
-	// Skip all Headers
+	method, target = fields[0], fields[1]
+	// Skip all Headers but Content-Length
+	var clen int64
 	for {
 		line, err := reader.ReadString('\n')
 		if err != nil {
-			return "", "", err
+			return "", "", "", err
 		}
 		if line == "\r\n" || line == "\n" {
 			break
 		}
+		name, value, _ := strings.Cut(line, ":")
+		if textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name)) == "Content-Length" {
+			clen, err = strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			if err != nil || clen < 0 {
+				return "", "", "", errBadRequest
+			}
+		}
+	}
+	data, err := io.ReadAll(io.LimitReader(reader, clen))
+	if err != nil {
+		return "", "", "", err
 	}
-	body, err := io.ReadAll(reader)
-	if err != nil && err != io.EOF {
-		return "", "", err
+	if int64(len(data)) < clen {
+		return "", "", "", io.ErrUnexpectedEOF
 	}
-	return method, string(body), nil
+	return method, target, string(data), nil
 }
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func FuzzParseReq(f *testing.F) {
+	for _, seed := range []string{
+		"GET / HTTP/1.1\r\nHost: localhost\r\n\r\n",
+		"POST /echo HTTP/1.1\r\nContent-Length: 5\r\n\r\nhello",
+		"POST /echo HTTP/1.1\r\ncontent-length:  2 \r\n\r\nhi there",
+		"POST / HTTP/1.1\r\nContent-Length: -1\r\n\r\n",
+		"POST / HTTP/1.1\r\nContent-Length: 9\r\n\r\nshort",
+		"GET /\n\n",
+		"\r\n\r\n",
+		"GET\r\n\r\n",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, raw string) {
+		method, target, body, err := parseReq(strings.NewReader(raw))
+		if err != nil {
+			return
+		}
+		if method == "" || target == "" || strings.ContainsAny(method+target, " \t\r\n") {
+			t.Fatalf("Parsed %q into method %q target %q", raw, method, target)
+		}
+
+		again := method + " " + target + " HTTP/1.1\r\n" +
+			"Content-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body
+		m2, t2, b2, err := parseReq(strings.NewReader(again))
+		if err != nil || m2 != method || t2 != target || b2 != body {
+			t.Fatalf("Round trip of %q gave %q %q %q, %v", again, m2, t2, b2, err)
+		}
+	})
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// authRule protects every path under prefix with HTTP Basic auth.
+type authRule struct {
+	prefix string
+	realm  string
+	users  *htpasswd
+}
+
+// htpasswd is a credential file of user:hash lines. Supported hashes
+// are bcrypt ($2a$, $2b$, $2y$, as written by htpasswd -B) and
+// {SSHA256}, the salted SHA-256 counterpart of LDAP's {SSHA}:
+// base64(sha256(password + salt) + salt).
+type htpasswd struct {
+	hashes map[string]string
+	dummy  string // checked for unknown users so they cost the same time
+}
+
+// dummyPassword is hashed to make the dummy; no one can log in with
+// it since only unknown users are checked against the dummy.
+const dummyPassword = "unknown user"
+
+const ssha256Prefix = "{SSHA256}"
+
+func loadHtpasswd(fname string) (*htpasswd, error) {
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	h := &htpasswd{hashes: make(map[string]string)}
+	maxCost := 0
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("%s:%d: want user:hash", fname, n)
+		}
+		switch {
+		case strings.HasPrefix(hash, "$2"):
+			cost, err := bcrypt.Cost([]byte(hash))
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: bad bcrypt hash for %q: %v", fname, n, user, err)
+			}
+			maxCost = max(maxCost, cost)
+		case strings.HasPrefix(hash, ssha256Prefix):
+			if h.dummy == "" {
+				h.dummy = hash
+			}
+		default:
+			return nil, fmt.Errorf("%s:%d: unsupported hash for %q", fname, n, user)
+		}
+		h.hashes[user] = hash
+	}
+	if len(h.hashes) == 0 {
+		return nil, fmt.Errorf("%s: no users", fname)
+	}
+	// The dummy must cost as much as the dearest real hash, or how
+	// long a failure takes tells which user names exist.
+	if maxCost > 0 {
+		dummy, err := bcrypt.GenerateFromPassword([]byte(dummyPassword), maxCost)
+		if err != nil {
+			return nil, err
+		}
+		h.dummy = string(dummy)
+	}
+	return h, nil
+}
+
+// check reports whether the password is right for user.
+func (h *htpasswd) check(user, password string) bool {
+	hash, ok := h.hashes[user]
+	if !ok {
+		hash = h.dummy
+	}
+	return checkHash(hash, password) && ok
+}
+
+func checkHash(hash, password string) bool {
+	if rest, ok := strings.CutPrefix(hash, ssha256Prefix); ok {
+		raw, err := base64.StdEncoding.DecodeString(rest)
+		if err != nil || len(raw) <= sha256.Size {
+			return false
+		}
+		digest, salt := raw[:sha256.Size], raw[sha256.Size:]
+		sum := sha256.Sum256(append([]byte(password), salt...))
+		return subtle.ConstantTimeCompare(sum[:], digest) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// authFor returns the rule with the longest prefix covering urlPath.
+func (s *site) authFor(urlPath string) *authRule {
+	var best *authRule
+	for i, r := range s.auth {
+		if !pathHasPrefix(urlPath, r.prefix) {
+			continue
+		}
+		if best == nil || len(r.prefix) > len(best.prefix) {
+			best = &s.auth[i]
+		}
+	}
+	return best
+}
+
+// pathHasPrefix is strings.HasPrefix on whole path elements, so
+// /private covers /private and /private/x but not /privateer.
+func pathHasPrefix(urlPath, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if !strings.HasPrefix(urlPath, prefix) {
+		return false
+	}
+	rest := urlPath[len(prefix):]
+	return rest == "" || rest[0] == '/'
+}
+
+// authorized checks the request against the auth rule for its path
+// and writes a 401 when it fails.
+func (s *site) authorized(b *bytes.Buffer, req *request) bool {
+	rule := s.authFor(req.path)
+	if rule == nil {
+		return true
+	}
+	user, password, err := basicCredentials(req.header["Authorization"])
+	if err == nil && rule.users.check(user, password) {
+		return true
+	}
+	status := "401 Unauthorized"
+	buildResp(b, status, "text/plain", strconv.Itoa(len(status)),
+		"WWW-Authenticate: Basic realm="+strconv.Quote(rule.realm)+`, charset="UTF-8"`)
+	b.WriteString(status)
+	return false
+}
+
+var errNoCredentials = errors.New("no basic credentials")
+
+// basicCredentials decodes an "Authorization: Basic base64(user:pass)"
+// value.
+func basicCredentials(value string) (user, password string, err error) {
+	scheme, encoded, ok := strings.Cut(strings.TrimSpace(value), " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return "", "", errNoCredentials
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", "", errNoCredentials
+	}
+	user, password, ok = strings.Cut(string(raw), ":")
+	if !ok {
+		return "", "", errNoCredentials
+	}
+	return user, password, nil
+}
+
+// authFlag collects repeated -auth prefix=file[=realm] flags.
+type authFlag []authRule
+
+func (f *authFlag) String() string {
+	var parts []string
+	for _, r := range *f {
+		parts = append(parts, r.prefix)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f *authFlag) Set(v string) error {
+	parts := strings.SplitN(v, "=", 3)
+	if len(parts) < 2 || !strings.HasPrefix(parts[0], "/") || parts[1] == "" {
+		return fmt.Errorf("want /prefix=file[=realm], got %q", v)
+	}
+	users, err := loadHtpasswd(parts[1])
+	if err != nil {
+		return err
+	}
+	realm := parts[0]
+	if len(parts) == 3 {
+		realm = parts[2]
+	}
+	*f = append(*f, authRule{prefix: parts[0], realm: realm, users: users})
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func ssha256(password, salt string) string {
+	sum := sha256.Sum256([]byte(password + salt))
+	return ssha256Prefix + base64.StdEncoding.EncodeToString(append(sum[:], salt...))
+}
+
+func testHtpasswd(t *testing.T) string {
+	t.Helper()
+	bhash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fname := filepath.Join(t.TempDir(), "htpasswd")
+	data := "# test users\n" +
+		"alice:" + string(bhash) + "\n" +
+		"\n" +
+		"bob:" + ssha256("s3cret", "NaCl") + "\n"
+	if err := os.WriteFile(fname, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return fname
+}
+
+func TestHtpasswdCheck(t *testing.T) {
+	users, err := loadHtpasswd(testHtpasswd(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testcases := []struct {
+		user     string
+		password string
+		ok       bool
+	}{
+		{"alice", "hunter2", true},
+		{"alice", "hunter3", false},
+		{"bob", "s3cret", true},
+		{"bob", "s3cret ", false},
+		{"bob", "", false},
+		{"carol", "hunter2", false},
+		{"", "", false},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.user+":"+tc.password, func(t *testing.T) {
+			if got := users.check(tc.user, tc.password); got != tc.ok {
+				t.Errorf("Got %v, want %v", got, tc.ok)
+			}
+		})
+	}
+}
+
+func TestHtpasswdDummy(t *testing.T) {
+	cheap, _ := bcrypt.GenerateFromPassword([]byte("a"), bcrypt.MinCost)
+	dear, _ := bcrypt.GenerateFromPassword([]byte("b"), bcrypt.MinCost+1)
+	testcases := []struct {
+		name string
+		data string
+		cost int // of the bcrypt dummy; 0 for an {SSHA256} one
+	}{
+		// An {SSHA256} user first must not make unknown users cheap.
+		{"mixed", "bob:" + ssha256("s3cret", "NaCl") + "\nalice:" + string(cheap) + "\ncarol:" + string(dear) + "\n", bcrypt.MinCost + 1},
+		{"bcrypt only", "alice:" + string(cheap) + "\n", bcrypt.MinCost},
+		{"ssha256 only", "bob:" + ssha256("s3cret", "NaCl") + "\n", 0},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			fname := filepath.Join(t.TempDir(), "htpasswd")
+			os.WriteFile(fname, []byte(tc.data), 0o600)
+			users, err := loadHtpasswd(fname)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cost, err := bcrypt.Cost([]byte(users.dummy))
+			if tc.cost == 0 {
+				if !strings.HasPrefix(users.dummy, ssha256Prefix) {
+					t.Errorf("Got dummy %q, want an {SSHA256} one", users.dummy)
+				}
+			} else if err != nil || cost != tc.cost {
+				t.Errorf("Got dummy cost %d, %v; want %d", cost, err, tc.cost)
+			}
+			if users.check("nobody", dummyPassword) {
+				t.Error("Unknown user logged in with the dummy's password")
+			}
+		})
+	}
+}
+
+func TestLoadHtpasswdErrors(t *testing.T) {
+	testcases := map[string]string{
+		"no colon": "alice\n",
+		"plain":    "alice:hunter2\n",
+		"bad cost": "alice:$2a$xx$\n",
+		"empty":    "# nobody\n",
+	}
+	for name, data := range testcases {
+		t.Run(name, func(t *testing.T) {
+			fname := filepath.Join(t.TempDir(), "htpasswd")
+			os.WriteFile(fname, []byte(data), 0o600)
+			if _, err := loadHtpasswd(fname); err == nil {
+				t.Error("Expected error")
+			}
+		})
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	users, err := loadHtpasswd(testHtpasswd(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := t.TempDir()
+	os.Mkdir(filepath.Join(root, "private"), 0o755)
+	writeFile(t, root, "private/drop.txt", "dropped")
+	writeFile(t, root, "privateer.txt", "public")
+	s := &server{def: &site{
+		root: root,
+		auth: []authRule{{prefix: "/private/", realm: "File drops", users: users}},
+	}}
+
+	basic := func(userpass string) string {
+		return "Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(userpass)) + "\r\n"
+	}
+	testcases := []struct {
+		name   string
+		path   string
+		auth   string
+		status string
+	}{
+		{"no credentials", "/private/drop.txt", "", "401 Unauthorized"},
+		{"dir itself", "/private", "", "401 Unauthorized"},
+		{"bcrypt user", "/private/drop.txt", basic("alice:hunter2"), "200 OK"},
+		{"ssha256 user", "/private/drop.txt", basic("bob:s3cret"), "200 OK"},
+		{"wrong password", "/private/drop.txt", basic("bob:nope"), "401 Unauthorized"},
+		{"unknown user", "/private/drop.txt", basic("eve:hunter2"), "401 Unauthorized"},
+		{"bad base64", "/private/drop.txt", "Authorization: Basic !!!\r\n", "401 Unauthorized"},
+		{"other scheme", "/private/drop.txt", "Authorization: Bearer abc\r\n", "401 Unauthorized"},
+		{"outside prefix", "/privateer.txt", "", "200 OK"},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := roundTrip(t, s, "GET "+tc.path+" HTTP/1.1\r\nHost: test\r\n"+tc.auth+"\r\n")
+			if !strings.HasPrefix(resp, "HTTP/1.1 "+tc.status+"\r\n") {
+				t.Fatalf("Got %q, want status %s", firstLine(resp), tc.status)
+			}
+			head, _, _ := strings.Cut(resp, "\r\n\r\n")
+			challenge := headerValue(head, "WWW-Authenticate")
+			if tc.status == "401 Unauthorized" && challenge != `Basic realm="File drops", charset="UTF-8"` {
+				t.Errorf("Got challenge %q", challenge)
+			}
+		})
+	}
+}
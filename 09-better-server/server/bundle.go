@@ -0,0 +1,15 @@
+//go:build bundle
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+)
+
+//go:embed all:bundle
+var bundleFiles embed.FS
+
+func init() {
+	bundle, _ = fs.Sub(bundleFiles, "bundle")
+}
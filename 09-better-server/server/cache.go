@@ -0,0 +1,158 @@
+package main
+
+import (
+	"container/list"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// fileCache keeps the contents of small, frequently requested files
+// in memory. It holds at most maxBytes of file data and evicts the
+// least recently used entry to make room. An entry is only used while
+// the file on disk still has the size and mtime it was read with.
+type fileCache struct {
+	maxBytes int64 // budget for all cached file data
+	maxFile  int64 // larger files are always read from disk
+
+	mu    sync.Mutex
+	used  int64
+	lru   *list.List               // front is most recently used
+	items map[string]*list.Element // value is *cacheEntry
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+type cacheEntry struct {
+	path    string
+	size    int64
+	modTime time.Time
+	data    []byte
+}
+
+// cacheStats is a snapshot of the cache counters.
+type cacheStats struct {
+	Hits    int64
+	Misses  int64
+	Entries int
+	Bytes   int64
+}
+
+func newFileCache(maxBytes, maxFile int64) *fileCache {
+	return &fileCache{
+		maxBytes: maxBytes,
+		maxFile:  maxFile,
+		lru:      list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// readFile is fs.ReadFile served from memory when possible. key names
+// the file apart from those in other file systems. A nil cache reads
+// straight from fsys.
+func (c *fileCache) readFile(fsys fs.FS, name, key string) ([]byte, error) {
+	if c == nil {
+		return fs.ReadFile(fsys, name)
+	}
+
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	// Stat the open file so the data read below matches the size and
+	// mtime we store, even if the file is replaced meanwhile.
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if data, ok := c.get(key, info); ok {
+		c.hits.Add(1)
+		return data, nil
+	}
+	c.misses.Add(1)
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode().IsRegular() && int64(len(data)) == info.Size() {
+		c.put(key, info, data)
+	}
+	return data, nil
+}
+
+// get returns the cached data for fpath if it is still current,
+// dropping the entry when the file changed.
+func (c *fileCache) get(fpath string, info os.FileInfo) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[fpath]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*cacheEntry)
+	if e.size != info.Size() || !e.modTime.Equal(info.ModTime()) {
+		c.remove(el)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return e.data, true
+}
+
+func (c *fileCache) put(fpath string, info os.FileInfo, data []byte) {
+	size := int64(len(data))
+	if size > c.maxFile || size > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[fpath]; ok {
+		c.remove(el)
+	}
+	for c.used+size > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+	e := &cacheEntry{path: fpath, size: size, modTime: info.ModTime(), data: data}
+	c.items[fpath] = c.lru.PushFront(e)
+	c.used += size
+}
+
+// remove drops an entry. The caller holds c.mu.
+func (c *fileCache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*cacheEntry)
+	delete(c.items, e.path)
+	c.used -= e.size
+}
+
+func (c *fileCache) stats() cacheStats {
+	if c == nil {
+		return cacheStats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return cacheStats{
+		Hits:    c.hits.Load(),
+		Misses:  c.misses.Load(),
+		Entries: c.lru.Len(),
+		Bytes:   c.used,
+	}
+}
+
+// logCacheStats logs the cache counters every interval.
+func logCacheStats(c *fileCache, interval time.Duration) {
+	for range time.Tick(interval) {
+		st := c.stats()
+		log.Printf("Cache: %d hits, %d misses, %d files, %d bytes",
+			st.Hits, st.Misses, st.Entries, st.Bytes)
+	}
+}
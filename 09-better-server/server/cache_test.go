@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeFile(t testing.TB, dir, name, data string) string {
+	t.Helper()
+	p := filepath.Join(dir, name)
+	if err := os.WriteFile(p, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// readPath reads the file at p on disk through c.
+func readPath(c *fileCache, p string) ([]byte, error) {
+	return c.readFile(os.DirFS(filepath.Dir(p)), filepath.Base(p), p)
+}
+
+func TestFileCacheHitMiss(t *testing.T) {
+	dir := t.TempDir()
+	p := writeFile(t, dir, "a.txt", "hello")
+	c := newFileCache(1<<10, 1<<10)
+
+	for i := 0; i < 3; i++ {
+		data, err := readPath(c, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "hello" {
+			t.Fatalf("Got %q, want %q", data, "hello")
+		}
+	}
+	st := c.stats()
+	if st.Hits != 2 || st.Misses != 1 {
+		t.Errorf("Got %d hits, %d misses, want 2, 1", st.Hits, st.Misses)
+	}
+	if st.Entries != 1 || st.Bytes != 5 {
+		t.Errorf("Got %d entries, %d bytes, want 1, 5", st.Entries, st.Bytes)
+	}
+}
+
+func TestFileCacheInvalidation(t *testing.T) {
+	dir := t.TempDir()
+	p := writeFile(t, dir, "a.txt", "one")
+	c := newFileCache(1<<10, 1<<10)
+	readPath(c, p)
+
+	// Same size, new mtime.
+	writeFile(t, dir, "a.txt", "two")
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(p, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := readPath(c, p); string(data) != "two" {
+		t.Errorf("After mtime change got %q, want %q", data, "two")
+	}
+
+	// New size, mtime forced back to the cached one.
+	writeFile(t, dir, "a.txt", "three")
+	if err := os.Chtimes(p, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := readPath(c, p); string(data) != "three" {
+		t.Errorf("After size change got %q, want %q", data, "three")
+	}
+
+	if st := c.stats(); st.Misses != 3 || st.Hits != 0 || st.Bytes != 5 {
+		t.Errorf("Got %+v, want 3 misses, 0 hits, 5 bytes", st)
+	}
+}
+
+func TestFileCacheEviction(t *testing.T) {
+	dir := t.TempDir()
+	a := writeFile(t, dir, "a", "aaaa")
+	b := writeFile(t, dir, "b", "bbbb")
+	cc := writeFile(t, dir, "c", "cccc")
+	big := writeFile(t, dir, "big", "0123456789")
+	c := newFileCache(8, 8)
+
+	readPath(c, a)
+	readPath(c, b)
+	readPath(c, a) // a is now the most recently used
+	readPath(c, cc)
+
+	c.mu.Lock()
+	_, hasA := c.items[a]
+	_, hasB := c.items[b]
+	_, hasC := c.items[cc]
+	c.mu.Unlock()
+	if !hasA || hasB || !hasC {
+		t.Errorf("Got a=%v b=%v c=%v, want b evicted", hasA, hasB, hasC)
+	}
+
+	readPath(c, big)
+	if st := c.stats(); st.Entries != 2 || st.Bytes != 8 {
+		t.Errorf("Oversized file changed the cache: %+v", st)
+	}
+}
+
+// BenchmarkSmallFile serves the same small file over and over, with
+// and without the cache in front of the disk.
+func BenchmarkSmallFile(b *testing.B) {
+	root := b.TempDir()
+	writeFile(b, root, "small.txt", string(bytes.Repeat([]byte("x"), 2<<10)))
+	req := &request{method: "GET", path: "/small.txt", header: map[string]string{}}
+
+	for _, cached := range []bool{false, true} {
+		s := &site{root: root}
+		if cached {
+			s.cache = newFileCache(1<<20, 64<<10)
+		}
+		b.Run(fmt.Sprintf("cache=%v", cached), func(b *testing.B) {
+			var resp bytes.Buffer
+			for b.Loop() {
+				resp.Reset()
+				s.servePath(&resp, req)
+			}
+		})
+	}
+}
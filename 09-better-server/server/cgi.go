@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"maps"
+	"net"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Local redirects a chain of CGI scripts may take before the server
+// gives up on them as a loop.
+const maxLocalRedirects = 10
+
+// serveCGI runs the script urlPath names under the CGI mount m, as
+// RFC 3875 describes. The request body is piped to the script's
+// stdin. The header block it prints is turned into our status line
+// and headers, and the rest of its output is streamed to the client
+// as it comes. Without a Content-Length from the script HTTP/1.1
+// clients get it in chunks, ending with a Server-Timing trailer, and
+// older ones until the connection closes. Scripts still running after
+// s.cgiTimeout are killed.
+func (s *site) serveCGI(c net.Conn, b *bytes.Buffer, req *request, m mount, urlPath string) {
+	script, scriptName, pathInfo, err := s.findScript(m, urlPath)
+	if err != nil {
+		sendFileError(b, err)
+		return
+	}
+
+	clen, _ := strconv.ParseInt(req.header["Content-Length"], 10, 64)
+	if clen < 0 {
+		clen = 0
+	}
+
+	// exec resolves a relative Path against Dir, not our working
+	// directory.
+	script, err = filepath.Abs(script)
+	if err != nil {
+		sendError(b, "500 Internal Server Error")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.cgiTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, script)
+	cmd.Dir = filepath.Dir(script)
+	cmd.Env = s.cgiEnv(c, req, scriptName, pathInfo, clen)
+	cmd.Stdin = io.LimitReader(req.body, clen)
+	cmd.Stderr = cgiLog(scriptName)
+	cmd.WaitDelay = time.Second // don't wait on pipes a killed script's children hold open
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		sendError(b, "500 Internal Server Error")
+		return
+	}
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		log.Printf("CGI %s: %v", scriptName, err)
+		sendError(b, "500 Internal Server Error")
+		return
+	}
+	defer cmd.Wait()
+
+	out := bufio.NewReader(stdout)
+	status, fields, err := readCGIHeader(out)
+	if err != nil {
+		cancel()
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			sendError(b, "504 Gateway Timeout")
+		} else {
+			log.Printf("CGI %s: bad header block: %v", scriptName, err)
+			sendError(b, "502 Bad Gateway")
+		}
+		return
+	}
+
+	// A local Location with no Status asks the server to answer as
+	// if the client had requested that path instead (RFC 3875, 6.2.2),
+	// so it passes the auth rules and mounts as that request would.
+	location := fields["Location"]
+	if strings.HasPrefix(location, "/") && status == "" {
+		cancel()
+		if req.redirects >= maxLocalRedirects {
+			log.Printf("CGI %s: more than %d local redirects", scriptName, maxLocalRedirects)
+			sendError(b, "500 Internal Server Error")
+			return
+		}
+		target, query, _ := strings.Cut(location, "?")
+		local := *req
+		local.method, local.target, local.path, local.query = "GET", location, cleanPath(target), query
+		local.header = maps.Clone(req.header)
+		for _, name := range []string{"Content-Length", "Content-Type", "Transfer-Encoding"} {
+			delete(local.header, name)
+		}
+		local.body = strings.NewReader("") // the script had the body
+		local.redirects++
+		if s.authorized(b, &local) {
+			s.dispatch(c, b, &local)
+		}
+		return
+	}
+
+	if status == "" {
+		status = "200 OK"
+		if location != "" {
+			status = "302 Found"
+		}
+	}
+	ctype := fields["Content-Type"]
+	if ctype == "" {
+		ctype = "text/plain" // a bare redirect
+	}
+	clenOut := fields["Content-Length"]
+	delete(fields, "Content-Type")
+	delete(fields, "Content-Length")
+	var extra []string
+	for _, name := range slices.Sorted(maps.Keys(fields)) {
+		extra = append(extra, name+": "+fields[name])
+	}
+
+	var cw *chunkedWriter
+	if clenOut == "" && req.proto == "HTTP/1.1" && bodyAllowed(status) {
+		cw = newChunkedWriter(c)
+		extra = append(extra, "Transfer-Encoding: chunked", "Trailer: Server-Timing")
+	}
+
+	var head bytes.Buffer
+	buildResp(&head, status, ctype, clenOut, extra...)
+	if _, err := head.WriteTo(c); err != nil {
+		cancel()
+		return
+	}
+	var body io.Writer = c
+	if cw != nil {
+		body = cw
+	}
+	_, err = io.Copy(body, out)
+	if err != nil {
+		cancel()
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		log.Printf("CGI %s: killed after %v", scriptName, s.cgiTimeout)
+		return // no last chunk, the client sees the output was cut short
+	}
+	if cw != nil && err == nil {
+		ms := float64(time.Since(start).Microseconds()) / 1000
+		cw.Close("Server-Timing: cgi;dur=" + strconv.FormatFloat(ms, 'f', 1, 64))
+	}
+}
+
+// findScript walks urlPath one element at a time until it reaches an
+// executable file. What follows it becomes PATH_INFO, so
+// /cgi-bin/env.sh/a/b runs env.sh with PATH_INFO=/a/b.
+func (s *site) findScript(m mount, urlPath string) (script, scriptName, pathInfo string, err error) {
+	elems := strings.Split(strings.TrimPrefix(urlPath, "/"), "/")
+	for i := range elems {
+		rel := "/" + strings.Join(elems[:i+1], "/")
+		fpath, err := s.policy.resolve(m.root, rel)
+		if err != nil {
+			return "", "", "", err
+		}
+		info, err := os.Stat(fpath)
+		if err != nil {
+			return "", "", "", err
+		}
+		if info.IsDir() {
+			continue
+		}
+		if info.Mode()&0o111 == 0 {
+			return "", "", "", os.ErrPermission
+		}
+		if len(elems[i+1:]) > 0 {
+			pathInfo = "/" + strings.Join(elems[i+1:], "/")
+		}
+		scriptName = strings.TrimSuffix(m.prefix, "/") + rel
+		return fpath, scriptName, pathInfo, nil
+	}
+	return "", "", "", os.ErrNotExist
+}
+
+// cgiEnv builds the meta-variables of RFC 3875, section 4.1, plus an
+// HTTP_* variable for every other request header.
+func (s *site) cgiEnv(c net.Conn, req *request, scriptName, pathInfo string, clen int64) []string {
+	remoteHost, remotePort, _ := net.SplitHostPort(c.RemoteAddr().String())
+	_, serverPort, _ := net.SplitHostPort(c.LocalAddr().String())
+	serverName := normalizeHost(req.header["Host"])
+	if serverName == "" {
+		serverName, _, _ = net.SplitHostPort(c.LocalAddr().String())
+	}
+
+	env := []string{
+		"GATEWAY_INTERFACE=CGI/1.1",
+		"SERVER_SOFTWARE=better-server",
+		"SERVER_NAME=" + serverName,
+		"SERVER_PORT=" + serverPort,
+		"SERVER_PROTOCOL=" + req.proto,
+		"REQUEST_METHOD=" + req.method,
+		"SCRIPT_NAME=" + scriptName,
+		"PATH_INFO=" + pathInfo,
+		"QUERY_STRING=" + req.query,
+		"REMOTE_ADDR=" + remoteHost,
+		"REMOTE_HOST=" + remoteHost,
+		"REMOTE_PORT=" + remotePort,
+		"PATH=" + os.Getenv("PATH"),
+	}
+	if pathInfo != "" {
+		env = append(env, "PATH_TRANSLATED="+filepath.Join(s.root, filepath.FromSlash(pathInfo)))
+	}
+	if clen > 0 {
+		env = append(env, "CONTENT_LENGTH="+strconv.FormatInt(clen, 10))
+	}
+	if ctype := req.header["Content-Type"]; ctype != "" {
+		env = append(env, "CONTENT_TYPE="+ctype)
+	}
+	if s.authFor(req.path) != nil {
+		// authorized has already checked these
+		if user, _, err := basicCredentials(req.header["Authorization"]); err == nil {
+			env = append(env, "AUTH_TYPE=Basic", "REMOTE_USER="+user)
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(req.header)) {
+		switch name {
+		case "Authorization", "Proxy-Authorization", "Content-Length", "Content-Type":
+			continue // passed above, or not at all
+		}
+		key, ok := cgiEnvName(name)
+		if !ok || key == "HTTP_PROXY" {
+			// A Proxy field would point the script's own HTTP client
+			// at whoever sent it (httpoxy, CVE-2016-5385).
+			continue
+		}
+		env = append(env, key+"="+req.header[name])
+	}
+	return env
+}
+
+// cgiEnvName turns a header field name into its HTTP_ variable name,
+// or reports false when the name holds characters, such as "=", that
+// can't be part of one.
+func cgiEnvName(field string) (string, bool) {
+	for _, c := range []byte(field) {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_') {
+			return "", false
+		}
+	}
+	return "HTTP_" + strings.ToUpper(strings.ReplaceAll(field, "-", "_")), true
+}
+
+var errCGIHeader = errors.New("missing Content-Type, Location or Status")
+
+// readCGIHeader parses the script's header block. Status becomes the
+// status line and everything else is kept for the response.
+func readCGIHeader(r *bufio.Reader) (status string, fields map[string]string, err error) {
+	fields = make(map[string]string)
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			return "", nil, err
+		}
+		if line == "" {
+			break
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return "", nil, errCGIHeader
+		}
+		name = textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name))
+		value = strings.TrimSpace(value)
+		if name == "Status" {
+			status = value
+			continue
+		}
+		fields[name] = value
+	}
+	if fields["Content-Type"] == "" && fields["Location"] == "" && status == "" {
+		return "", nil, errCGIHeader
+	}
+	return status, fields, nil
+}
+
+// cgiLog sends a script's stderr to the server log.
+type cgiLog string
+
+func (name cgiLog) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		log.Printf("CGI %s: %s", string(name), line)
+	}
+	return len(p), nil
+}
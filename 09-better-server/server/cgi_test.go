@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/base64"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCGI(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh to run scripts with")
+	}
+	root, bin := t.TempDir(), t.TempDir()
+	writeFile(t, root, "moved.txt", "moved here")
+	if err := os.Mkdir(filepath.Join(root, "private"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, root, "private/secret.txt", "secret")
+	users, err := loadHtpasswd(testHtpasswd(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	scripts := map[string]string{
+		"env.sh": "#!/bin/sh\n" +
+			"printf 'Content-Type: text/plain\\r\\nX-Script: env\\r\\n\\r\\n'\n" +
+			"echo \"method=$REQUEST_METHOD\"\n" +
+			"echo \"script=$SCRIPT_NAME\"\n" +
+			"echo \"info=$PATH_INFO\"\n" +
+			"echo \"query=$QUERY_STRING\"\n" +
+			"echo \"agent=$HTTP_USER_AGENT\"\n" +
+			"echo \"gateway=$GATEWAY_INTERFACE\"\n" +
+			"echo \"proxy=$HTTP_PROXY\"\n" +
+			"env | grep -c '^HTTP_' | sed 's/^/http_vars=/'\n",
+		"echo.sh": "#!/bin/sh\n" +
+			"echo 'Content-Type: text/plain'\n" +
+			"echo\n" +
+			"echo \"len=$CONTENT_LENGTH type=$CONTENT_TYPE\"\n" +
+			"cat\n",
+		"status.sh": "#!/bin/sh\n" +
+			"echo 'Status: 418 I'\"'\"'m a teapot'\n" +
+			"echo 'Content-Type: text/plain'\n" +
+			"echo\n" +
+			"echo short and stout\n",
+		"redirect.sh": "#!/bin/sh\n" +
+			"echo 'Location: https://example.com/elsewhere'\n" +
+			"echo\n",
+		"local.sh": "#!/bin/sh\n" +
+			"echo 'Location: /moved.txt'\n" +
+			"echo\n",
+		"private.sh": "#!/bin/sh\n" +
+			"echo 'Location: /private/secret.txt'\n" +
+			"echo\n",
+		"hop.sh": "#!/bin/sh\n" +
+			"echo 'Location: /cgi-bin/env.sh/hopped?from=hop'\n" +
+			"echo\n",
+		"loop.sh": "#!/bin/sh\n" +
+			"echo 'Location: /cgi-bin/loop.sh'\n" +
+			"echo\n",
+		"slow.sh": "#!/bin/sh\n" +
+			"sleep 5\n" +
+			"echo 'Content-Type: text/plain'\n" +
+			"echo\n",
+		"broken.sh": "#!/bin/sh\n" +
+			"echo 'not a header block'\n",
+	}
+	for name, body := range scripts {
+		if err := os.WriteFile(filepath.Join(bin, name), []byte(body), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(t, bin, "plain.txt", "not executable")
+
+	s := &server{def: &site{
+		root:       root,
+		mounts:     []mount{{prefix: "/cgi-bin/", root: bin, cgi: true}},
+		cgiTimeout: 300 * time.Millisecond,
+		auth:       []authRule{{prefix: "/private", realm: "private", users: users}},
+	}}
+
+	testcases := []struct {
+		name   string
+		raw    string
+		status string
+		want   []string
+	}{
+		{
+			name:   "environment",
+			raw:    "GET /cgi-bin/env.sh/a/b?x=1&y=2 HTTP/1.1\r\nHost: test\r\nUser-Agent: tester\r\n\r\n",
+			status: "200 OK",
+			want: []string{
+				"X-Script: env\r\n", "method=GET\n", "script=/cgi-bin/env.sh\n",
+				"info=/a/b\n", "query=x=1&y=2\n", "agent=tester\n", "gateway=CGI/1.1\n",
+			},
+		},
+		{
+			name: "proxy and bad names dropped",
+			raw: "GET /cgi-bin/env.sh HTTP/1.1\r\nHost: test\r\nProxy: http://attacker.example\r\n" +
+				"X=Y: 1\r\nX Y: 2\r\nUser-Agent: tester\r\n\r\n",
+			status: "200 OK",
+			// Host and User-Agent only.
+			want: []string{"proxy=\n", "agent=tester\n", "http_vars=2\n"},
+		},
+		{
+			name:   "request body",
+			raw:    "POST /cgi-bin/echo.sh HTTP/1.1\r\nHost: test\r\nContent-Type: text/plain\r\nContent-Length: 5\r\n\r\nhello",
+			status: "200 OK",
+			want:   []string{"len=5 type=text/plain\nhello"},
+		},
+		{
+			name:   "status header",
+			raw:    "GET /cgi-bin/status.sh HTTP/1.1\r\nHost: test\r\n\r\n",
+			status: "418 I'm a teapot",
+			want:   []string{"short and stout\n"},
+		},
+		{
+			name:   "client redirect",
+			raw:    "GET /cgi-bin/redirect.sh HTTP/1.1\r\nHost: test\r\n\r\n",
+			status: "302 Found",
+			want:   []string{"Location: https://example.com/elsewhere\r\n"},
+		},
+		{
+			name:   "local redirect",
+			raw:    "GET /cgi-bin/local.sh HTTP/1.1\r\nHost: test\r\n\r\n",
+			status: "200 OK",
+			want:   []string{"moved here"},
+		},
+		{
+			name:   "local redirect under auth",
+			raw:    "GET /cgi-bin/private.sh HTTP/1.1\r\nHost: test\r\n\r\n",
+			status: "401 Unauthorized",
+		},
+		{
+			name: "local redirect with credentials",
+			raw: "GET /cgi-bin/private.sh HTTP/1.1\r\nHost: test\r\nAuthorization: Basic " +
+				base64.StdEncoding.EncodeToString([]byte("alice:hunter2")) + "\r\n\r\n",
+			status: "200 OK",
+			want:   []string{"secret"},
+		},
+		{
+			// Run, not served as a file from the CGI directory.
+			name:   "local redirect to a script",
+			raw:    "POST /cgi-bin/hop.sh HTTP/1.1\r\nHost: test\r\nContent-Length: 2\r\n\r\nhi",
+			status: "200 OK",
+			want:   []string{"X-Script: env\r\n", "method=GET\n", "info=/hopped\n", "query=from=hop\n"},
+		},
+		{
+			name:   "local redirect loop",
+			raw:    "GET /cgi-bin/loop.sh HTTP/1.1\r\nHost: test\r\n\r\n",
+			status: "500 Internal Server Error",
+		},
+		{
+			name:   "timeout",
+			raw:    "GET /cgi-bin/slow.sh HTTP/1.1\r\nHost: test\r\n\r\n",
+			status: "504 Gateway Timeout",
+		},
+		{
+			name:   "bad header block",
+			raw:    "GET /cgi-bin/broken.sh HTTP/1.1\r\nHost: test\r\n\r\n",
+			status: "502 Bad Gateway",
+		},
+		{
+			name:   "not executable",
+			raw:    "GET /cgi-bin/plain.txt HTTP/1.1\r\nHost: test\r\n\r\n",
+			status: "403 Forbidden",
+		},
+		{
+			name:   "missing",
+			raw:    "GET /cgi-bin/nope.sh HTTP/1.1\r\nHost: test\r\n\r\n",
+			status: "404 File not found",
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			start := time.Now()
+			resp := roundTrip(t, s, tc.raw)
+			if headerValue(resp, "Transfer-Encoding") == "chunked" {
+				head, raw, _ := strings.Cut(resp, "\r\n\r\n")
+				body, _, err := decodeChunked(raw)
+				if err != nil {
+					t.Fatalf("Decoding %q: %v", raw, err)
+				}
+				resp = head + "\r\n\r\n" + body
+			}
+			if !strings.HasPrefix(resp, "HTTP/1.1 "+tc.status+"\r\n") {
+				t.Fatalf("Got %q, want status %s", firstLine(resp), tc.status)
+			}
+			for _, w := range tc.want {
+				if !strings.Contains(resp, w) {
+					t.Errorf("Response %q lacks %q", resp, w)
+				}
+			}
+			if elapsed := time.Since(start); elapsed > 3*time.Second {
+				t.Errorf("Took %v, script was not killed in time", elapsed)
+			}
+		})
+	}
+}
+
+func TestCGIChunked(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh to run scripts with")
+	}
+	bin := t.TempDir()
+	scripts := map[string]string{
+		"stream.sh": "#!/bin/sh\n" +
+			"echo 'Content-Type: text/plain'\n" +
+			"echo\n" +
+			"echo one\n" +
+			"sleep 0.1\n" +
+			"echo two\n",
+		"sized.sh": "#!/bin/sh\n" +
+			"echo 'Content-Type: text/plain'\n" +
+			"echo 'Content-Length: 4'\n" +
+			"echo\n" +
+			"echo one\n",
+		"hang.sh": "#!/bin/sh\n" +
+			"echo 'Content-Type: text/plain'\n" +
+			"echo\n" +
+			"echo started\n" +
+			"sleep 5\n",
+	}
+	for name, body := range scripts {
+		if err := os.WriteFile(filepath.Join(bin, name), []byte(body), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := &server{def: &site{
+		root:       t.TempDir(),
+		mounts:     []mount{{prefix: "/cgi-bin/", root: bin, cgi: true}},
+		cgiTimeout: 300 * time.Millisecond,
+	}}
+
+	resp := roundTrip(t, s, "GET /cgi-bin/stream.sh HTTP/1.1\r\nHost: test\r\n\r\n")
+	if got := headerValue(resp, "Transfer-Encoding"); got != "chunked" {
+		t.Fatalf("Transfer-Encoding: got %q, want chunked", got)
+	}
+	_, raw, _ := strings.Cut(resp, "\r\n\r\n")
+	if !strings.HasPrefix(raw, "4\r\none\n\r\n") {
+		t.Errorf("Output before the sleep was not sent as its own chunk: %q", raw)
+	}
+	body, trailer, err := decodeChunked(raw)
+	if err != nil || body != "one\ntwo\n" {
+		t.Errorf("Got %q, %v", body, err)
+	}
+	if len(trailer) != 1 || !strings.HasPrefix(trailer[0], "Server-Timing: cgi;dur=") {
+		t.Errorf("Got trailer %q", trailer)
+	}
+
+	resp = roundTrip(t, s, "GET /cgi-bin/stream.sh HTTP/1.0\r\n\r\n")
+	if headerValue(resp, "Transfer-Encoding") != "" || !strings.HasSuffix(resp, "\r\n\r\none\ntwo\n") {
+		t.Errorf("HTTP/1.0 got %q", resp)
+	}
+
+	resp = roundTrip(t, s, "GET /cgi-bin/sized.sh HTTP/1.1\r\nHost: test\r\n\r\n")
+	if headerValue(resp, "Transfer-Encoding") != "" || !strings.HasSuffix(resp, "\r\n\r\none\n") {
+		t.Errorf("Sized output got %q", resp)
+	}
+
+	// Killed halfway, the body lacks its last chunk.
+	resp = roundTrip(t, s, "GET /cgi-bin/hang.sh HTTP/1.1\r\nHost: test\r\n\r\n")
+	_, raw, _ = strings.Cut(resp, "\r\n\r\n")
+	if body, _, err := decodeChunked(raw); err == nil {
+		t.Errorf("Killed script's output %q decoded as complete", body)
+	}
+}
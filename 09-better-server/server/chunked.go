@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Most body bytes a chunkedWriter buffers before sending a chunk.
+const chunkSize = 32 << 10
+
+// chunkedWriter frames a body of unknown length with the chunked
+// transfer coding (RFC 9112, 7.1), for HTTP/1.1 clients. Writes are
+// buffered into chunks of up to chunkSize and Flush sends what is
+// buffered right away. Close sends the last chunk and the trailer
+// fields, which the head should have announced in a Trailer field.
+//
+// A body that breaks off is left without its last chunk, so unlike
+// one delimited by closing the connection the client can tell it is
+// incomplete.
+type chunkedWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+func newChunkedWriter(w io.Writer) *chunkedWriter {
+	return &chunkedWriter{w: w, buf: make([]byte, 0, chunkSize)}
+}
+
+func (cw *chunkedWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		k := min(len(p), chunkSize-len(cw.buf))
+		cw.buf = append(cw.buf, p[:k]...)
+		p, n = p[k:], n+k
+		if len(cw.buf) == chunkSize {
+			if err := cw.Flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Flush sends the buffered bytes as one chunk. An empty buffer sends
+// nothing, as a chunk of size zero would end the body.
+func (cw *chunkedWriter) Flush() error {
+	if len(cw.buf) == 0 {
+		return nil
+	}
+	frame := strconv.AppendInt(nil, int64(len(cw.buf)), 16)
+	frame = append(frame, "\r\n"...)
+	frame = append(frame, cw.buf...)
+	frame = append(frame, "\r\n"...)
+	cw.buf = cw.buf[:0]
+	_, err := cw.w.Write(frame)
+	return err
+}
+
+// ReadFrom copies r into the body, flushing after every read so that
+// a stream such as CGI output reaches the client as it is produced.
+// io.Copy uses it. What was written before is flushed first, as the
+// next read may block; a bufio.Reader copying itself out writes what
+// it buffered just before calling ReadFrom.
+func (cw *chunkedWriter) ReadFrom(r io.Reader) (int64, error) {
+	if err := cw.Flush(); err != nil {
+		return 0, err
+	}
+	var total int64
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			total += int64(n)
+			if _, werr := cw.Write(buf[:n]); werr != nil {
+				return total, werr
+			}
+			if werr := cw.Flush(); werr != nil {
+				return total, werr
+			}
+		}
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// Close flushes and ends the body with the last chunk, followed by
+// the trailer fields given as "Name: value".
+func (cw *chunkedWriter) Close(trailer ...string) error {
+	if err := cw.Flush(); err != nil {
+		return err
+	}
+	end := "0\r\n"
+	for _, f := range trailer {
+		end += f + "\r\n"
+	}
+	_, err := io.WriteString(cw.w, end+"\r\n")
+	return err
+}
+
+// bodyAllowed reports whether a response with status may carry a
+// body, and so be chunked: 1xx, 204 and 304 responses never do.
+func bodyAllowed(status string) bool {
+	code, _ := strconv.Atoi(status[:min(3, len(status))])
+	return code >= 200 && code != 204 && code != 304
+}
+
+var errBadChunk = errors.New("malformed chunked encoding")
+
+// chunkedReader decodes a chunked body, returning io.EOF after the
+// last chunk. Chunk extensions are skipped. Once the body is read
+// trailer holds the trailer fields as "Name: value" lines.
+type chunkedReader struct {
+	r       *bufio.Reader
+	left    int64 // bytes of the current chunk not yet read
+	started bool  // a chunk was read, so its CRLF comes first
+	trailer []string
+	err     error // sticky, io.EOF once the body is done
+}
+
+func newChunkedReader(r *bufio.Reader) *chunkedReader {
+	return &chunkedReader{r: r}
+}
+
+func (cr *chunkedReader) Read(p []byte) (int, error) {
+	for cr.left == 0 && cr.err == nil {
+		cr.err = cr.nextChunk()
+	}
+	if cr.err != nil {
+		return 0, cr.err
+	}
+	n, err := cr.r.Read(p[:min(int64(len(p)), cr.left)])
+	cr.left -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		cr.err = err
+	}
+	return n, err
+}
+
+// nextChunk reads up to the data of the next chunk, or through the
+// trailer after the last one.
+func (cr *chunkedReader) nextChunk() error {
+	if cr.started {
+		if line, err := readChunkLine(cr.r); err != nil || line != "" {
+			return cmp.Or(err, errBadChunk)
+		}
+	}
+	cr.started = true
+
+	line, err := readChunkLine(cr.r)
+	if err != nil {
+		return err
+	}
+	size, _, _ := strings.Cut(line, ";")
+	size = strings.TrimRight(size, " \t")
+	if size == "" || strings.Trim(size, "0123456789abcdefABCDEF") != "" {
+		return errBadChunk
+	}
+	n, err := strconv.ParseInt(size, 16, 64)
+	if err != nil {
+		return errBadChunk
+	}
+	if n > 0 {
+		cr.left = n
+		return nil
+	}
+
+	for {
+		line, err := readChunkLine(cr.r)
+		if err != nil {
+			return err
+		}
+		if line == "" {
+			return io.EOF
+		}
+		if !strings.Contains(line, ":") {
+			return errBadChunk
+		}
+		cr.trailer = append(cr.trailer, line)
+	}
+}
+
+// readChunkLine is readLine for the inside of a body, where running
+// out of input means it was cut short.
+func readChunkLine(r *bufio.Reader) (string, error) {
+	line, err := readLine(r)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return line, err
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http/httputil"
+	"slices"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// decodeChunked reads a chunked body one byte at a time, so that
+// every chunk boundary falls between two reads.
+func decodeChunked(body string) (string, []string, error) {
+	cr := newChunkedReader(bufio.NewReaderSize(iotest.OneByteReader(strings.NewReader(body)), 16))
+	data, err := io.ReadAll(cr)
+	return string(data), cr.trailer, err
+}
+
+func TestChunkedWriter(t *testing.T) {
+	var b bytes.Buffer
+	cw := newChunkedWriter(&b)
+	cw.Write([]byte("hello, "))
+	cw.Flush()
+	cw.Flush() // nothing buffered, no empty chunk
+	cw.Write([]byte("world"))
+	cw.Close("Server-Timing: cgi;dur=1.5")
+
+	want := "7\r\nhello, \r\n5\r\nworld\r\n0\r\nServer-Timing: cgi;dur=1.5\r\n\r\n"
+	if b.String() != want {
+		t.Fatalf("Got %q, want %q", b.String(), want)
+	}
+
+	// Large writes are split and net/http reads them back.
+	b.Reset()
+	cw = newChunkedWriter(&b)
+	big := bytes.Repeat([]byte("0123456789"), chunkSize/4)
+	cw.Write(big)
+	cw.Close()
+	if !bytes.HasPrefix(b.Bytes(), []byte("8000\r\n")) {
+		t.Errorf("First chunk starts %q, want size 8000", b.Bytes()[:8])
+	}
+	got, err := io.ReadAll(httputil.NewChunkedReader(&b))
+	if err != nil || !bytes.Equal(got, big) {
+		t.Errorf("net/http read %d bytes, %v; want %d", len(got), err, len(big))
+	}
+}
+
+func TestChunkedReader(t *testing.T) {
+	testcases := []struct {
+		name    string
+		body    string
+		want    string
+		trailer []string
+		wantErr bool
+	}{
+		{name: "two chunks", body: "3\r\nabc\r\n2\r\nde\r\n0\r\n\r\n", want: "abcde"},
+		{name: "empty body", body: "0\r\n\r\n", want: ""},
+		{name: "hex and extensions", body: "A;name=value\r\n0123456789\r\n0 ; last\r\n\r\n", want: "0123456789"},
+		{name: "bare LF", body: "1\nx\n0\n\n", want: "x"},
+		{
+			name: "trailer", body: "2\r\nok\r\n0\r\nServer-Timing: cgi;dur=3\r\nX-Sum: 42\r\n\r\n",
+			want: "ok", trailer: []string{"Server-Timing: cgi;dur=3", "X-Sum: 42"},
+		},
+		{name: "size is not hex", body: "g\r\nx\r\n0\r\n\r\n", wantErr: true},
+		{name: "signed size", body: "+1\r\nx\r\n0\r\n\r\n", wantErr: true},
+		{name: "0x prefix", body: "0x1\r\nx\r\n0\r\n\r\n", wantErr: true},
+		{name: "size overflows", body: "10000000000000000\r\n", wantErr: true},
+		{name: "no size", body: "\r\nabc\r\n", wantErr: true},
+		{name: "data overruns size", body: "1\r\nxy\r\n0\r\n\r\n", wantErr: true},
+		{name: "bad trailer", body: "0\r\nno colon\r\n\r\n", wantErr: true},
+		{name: "cut in data", body: "5\r\nab", wantErr: true},
+		{name: "no last chunk", body: "2\r\nab\r\n", wantErr: true},
+		{name: "no final CRLF", body: "0\r\n", wantErr: true},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, trailer, err := decodeChunked(tc.body)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("Expected error, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if got != tc.want || !slices.Equal(trailer, tc.trailer) {
+				t.Errorf("Got %q %q, want %q %q", got, trailer, tc.want, tc.trailer)
+			}
+		})
+	}
+}
+
+func TestChunkedRoundTrip(t *testing.T) {
+	for _, size := range []int{1, 15, 16, 17, chunkSize - 1, chunkSize, chunkSize + 1, 3*chunkSize + 7} {
+		var b bytes.Buffer
+		cw := newChunkedWriter(&b)
+		body := strings.Repeat("x", size)
+		io.Copy(cw, iotest.HalfReader(strings.NewReader(body)))
+		cw.Close("X-Size: yes")
+
+		got, trailer, err := decodeChunked(b.String())
+		if err != nil || got != body || !slices.Equal(trailer, []string{"X-Size: yes"}) {
+			t.Errorf("Size %d: got %d bytes, trailer %q, %v", size, len(got), trailer, err)
+		}
+	}
+}
+
+func FuzzChunkedReader(f *testing.F) {
+	for _, seed := range []string{
+		"3\r\nabc\r\n0\r\n\r\n",
+		"A;ext\r\n0123456789\r\n0\r\nX: 1\r\n\r\n",
+		"1\nx\n0\n\n",
+		"+1\r\nx\r\n0\r\n\r\n",
+		"ffffffffffffffff\r\n",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, body string) {
+		got, trailer, err := decodeChunked(body)
+		if err != nil {
+			return
+		}
+		// Written back out and read again, the body is the same.
+		var b bytes.Buffer
+		cw := newChunkedWriter(&b)
+		cw.Write([]byte(got))
+		cw.Close(trailer...)
+		again, trailer2, err := decodeChunked(b.String())
+		if err != nil || again != got || !slices.Equal(trailer, trailer2) {
+			t.Fatalf("Round trip of %q gave %q %q, %v", got, again, trailer2, err)
+		}
+	})
+}
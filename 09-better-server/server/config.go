@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// config is what a config file sets and SIGHUP reloads: the sites,
+// their mounts and rules, client limits and error pages. The command
+// line gives the defaults and each field in the file replaces the flag
+// of the same name; repeatable flags are lists in the flag's syntax.
+// Paths are relative to the working directory, as on the command line.
+//
+// The listener, the cache, metrics, events, WebSockets and -epoll are
+// fixed at startup and only come from flags.
+type config struct {
+	Root          string   `json:"root"`
+	Strict        bool     `json:"strict"`
+	Hide          string   `json:"hide"`
+	Mounts        []string `json:"mount"`
+	Proxies       []string `json:"proxy"`
+	ProxyTimeout  duration `json:"proxy_timeout"`
+	Vhosts        []string `json:"vhost"`
+	Auth          []string `json:"auth"`
+	ErrorPages    []string `json:"error_page"`
+	MaxUpload     int64    `json:"max_upload"`
+	CGITimeout    duration `json:"cgi_timeout"`
+	Rate          float64  `json:"rate"`
+	Burst         int      `json:"burst"`
+	RateCIDR      string   `json:"rate_cidr"`
+	MaxConnsPerIP int      `json:"max_conns_per_ip"`
+	MaxConns      int      `json:"max_conns"`
+}
+
+// duration is a time.Duration written as in Go, e.g. "30s".
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("want a duration like \"30s\", got %s", data)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// loadConfig reads a JSON config file over the defaults. Unknown
+// fields are refused so that a misspelt one doesn't go unnoticed.
+func loadConfig(file string, defaults config) (config, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return config{}, err
+	}
+	// Decoding reuses a slice's array, which must stay the defaults'.
+	cfg := defaults
+	for _, list := range []*[]string{&cfg.Mounts, &cfg.Proxies, &cfg.Vhosts, &cfg.Auth, &cfg.ErrorPages} {
+		*list = slices.Clone(*list)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return config{}, fmt.Errorf("%s: %v", file, err)
+	}
+	return cfg, nil
+}
+
+// build makes a server for cfg, opening every file it names. What
+// isn't part of a config, the events hub, metrics and WebSocket demos,
+// is copied from base and the cache is shared.
+func (cfg *config) build(base *server, cache *fileCache) (*server, error) {
+	patterns, err := parsePatterns(cfg.Hide)
+	if err != nil {
+		return nil, fmt.Errorf("hide: %v", err)
+	}
+	var (
+		mounts  mountFlag
+		proxies proxyFlag
+		vhosts  vhostFlag
+		auth    authFlag
+		pages   errorPageFlag
+	)
+	for _, set := range []struct {
+		name   string
+		f      flag.Value
+		values []string
+	}{
+		{"mount", &mounts, cfg.Mounts},
+		{"proxy", &proxies, cfg.Proxies},
+		{"vhost", &vhosts, cfg.Vhosts},
+		{"auth", &auth, cfg.Auth},
+		{"error_page", &pages, cfg.ErrorPages},
+	} {
+		for _, v := range set.values {
+			if err := set.f.Set(v); err != nil {
+				return nil, fmt.Errorf("%s: %v", set.name, err)
+			}
+		}
+	}
+	for _, m := range proxies {
+		m.proxy.timeout = time.Duration(cfg.ProxyTimeout)
+		mounts = append(mounts, m)
+	}
+
+	pol := policy{strict: cfg.Strict, hide: patterns}
+	s := new(server)
+	*s = *base
+	s.conns, s.closers = new(connCount), nil
+	newSite := func(root string) (*site, error) {
+		files, err := openFiles(root)
+		if err != nil {
+			return nil, fmt.Errorf("cannot serve %s: %v", root, err)
+		}
+		if c, ok := files.(io.Closer); ok {
+			s.closers = append(s.closers, c)
+		}
+		return &site{root: root, files: files, policy: pol, cache: cache, auth: auth,
+			mounts: mounts, maxUpload: cfg.MaxUpload, cgiTimeout: time.Duration(cfg.CGITimeout),
+			events: base.events}, nil
+	}
+
+	if s.def, err = newSite(cfg.Root); err != nil {
+		return nil, err
+	}
+	s.vhosts = nil
+	for _, v := range vhosts {
+		name, dir, _ := strings.Cut(v, "=")
+		site, err := newSite(dir)
+		if err != nil {
+			s.closeFiles()
+			return nil, err
+		}
+		s.vhosts = append(s.vhosts, vhost{pattern: normalizeHost(name), site: site})
+	}
+	s.errorPages = errorPages(pages)
+
+	s.limits = nil
+	if cfg.Rate > 0 || cfg.MaxConnsPerIP > 0 || cfg.MaxConns > 0 {
+		groups, err := parseCIDRs(cfg.RateCIDR)
+		if err != nil {
+			s.closeFiles()
+			return nil, fmt.Errorf("rate_cidr: %v", err)
+		}
+		s.limits = newLimiter(cfg.Rate, cfg.Burst, cfg.MaxConnsPerIP, cfg.MaxConns, groups)
+	}
+	return s, nil
+}
+
+// sameLimits reports whether two configs limit clients alike, so a
+// reload may keep the limiter and with it the clients' counts.
+func sameLimits(a, b *config) bool {
+	return a.Rate == b.Rate && a.Burst == b.Burst && a.RateCIDR == b.RateCIDR &&
+		a.MaxConnsPerIP == b.MaxConnsPerIP && a.MaxConns == b.MaxConns
+}
+
+// reloader rebuilds the server from the config file, on SIGHUP. New
+// connections go to the rebuilt server while those already open finish
+// on the one they started with, so none are dropped; the archives the
+// old one opened are closed after the last of them. A config that
+// fails to load is logged and the running one stays.
+type reloader struct {
+	file  string
+	flags config  // the command line, which the file overrides
+	base  *server // the parts no reload replaces
+	cache *fileCache
+
+	conf *config // what the live server was built from
+}
+
+// newReloader loads the config file and makes the first server, which
+// reloads are swapped in for through base.live.
+func newReloader(file string, flags config, base *server, cache *fileCache) (*reloader, *server, error) {
+	base.live = new(atomic.Pointer[server])
+	r := &reloader{file: file, flags: flags, base: base, cache: cache}
+	s, err := r.load()
+	if err != nil {
+		return nil, nil, err
+	}
+	return r, s, nil
+}
+
+// load reads and builds the config and makes it live.
+func (r *reloader) load() (*server, error) {
+	cfg, err := loadConfig(r.file, r.flags)
+	if err != nil {
+		return nil, err
+	}
+	s, err := cfg.build(r.base, r.cache)
+	if err != nil {
+		return nil, err
+	}
+	old := r.base.live.Load()
+	if old != nil && old.limits != nil && s.limits != nil && sameLimits(r.conf, &cfg) {
+		s.limits = old.limits
+	}
+	r.conf = &cfg
+	r.base.live.Store(s)
+	if old != nil {
+		old.conns.retire(old.closeFiles)
+	}
+	return s, nil
+}
+
+// reload is load for SIGHUP, logging the outcome.
+func (r *reloader) reload() error {
+	if _, err := r.load(); err != nil {
+		log.Printf("Reload failed, keeping the running config: %v", err)
+		return err
+	}
+	log.Printf("Reloaded %s", r.file)
+	return nil
+}
+
+// current returns the server new connections are handed to: the last
+// config loaded, or s itself when there is no config file.
+func (s *server) current() *server {
+	if s.live == nil {
+		return s
+	}
+	return s.live.Load()
+}
+
+// acquire returns the server for a new connection, counted in its
+// conns until the caller releases it. A config retired between loading
+// it and counting the connection is passed over for the one that
+// replaced it.
+func (s *server) acquire() *server {
+	for {
+		if cur := s.current(); cur.conns.hold() {
+			return cur
+		}
+	}
+}
+
+// closeFiles closes the archives s opened.
+func (s *server) closeFiles() {
+	for _, c := range s.closers {
+		c.Close()
+	}
+}
+
+// connCount counts the connections being served by one config, so
+// that once it is replaced what it holds open can be closed after the
+// last of them. A nil *connCount counts nothing and is never retired.
+type connCount struct {
+	mu      sync.Mutex
+	n       int
+	retired bool
+	idle    func() // run by the release that ends the last connection
+}
+
+// hold counts a connection, unless the config has been retired.
+func (c *connCount) hold() bool {
+	if c == nil {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.retired {
+		return false
+	}
+	c.n++
+	return true
+}
+
+func (c *connCount) release() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.n--
+	var idle func()
+	if c.n == 0 {
+		idle, c.idle = c.idle, nil
+	}
+	c.mu.Unlock()
+	if idle != nil {
+		idle()
+	}
+}
+
+// retire refuses further connections and runs idle once those being
+// served are done, right away if there are none.
+func (c *connCount) retire(idle func()) {
+	c.mu.Lock()
+	c.retired = true
+	if c.n > 0 {
+		c.idle = idle
+		idle = nil
+	}
+	c.mu.Unlock()
+	if idle != nil {
+		idle()
+	}
+}
+
+// sweepLimits forgets idle clients of the current limiter every
+// interval.
+func (s *server) sweepLimits(interval time.Duration) {
+	for range time.Tick(interval) {
+		if l := s.current().limits; l != nil {
+			l.sweep()
+		}
+	}
+}
+
+// listFlag collects the values of a repeatable flag as given; they
+// are checked when the config is built.
+type listFlag []string
+
+func (f *listFlag) String() string { return strings.Join(*f, " ") }
+
+func (f *listFlag) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
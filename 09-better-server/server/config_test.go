@@ -0,0 +1,198 @@
+package main
+
+import (
+	"io"
+	"io/fs"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	flags := config{Root: "./flag-root", Burst: 10, MaxUpload: 100, Mounts: []string{"/m=./flag"}}
+
+	testcases := []struct {
+		name    string
+		data    string
+		want    func(c config) bool
+		wantErr bool
+	}{
+		{
+			name: "file overrides flags",
+			data: `{"root": "./site", "mount": ["/up=./up,rw"], "cgi_timeout": "5s"}`,
+			want: func(c config) bool {
+				return c.Root == "./site" && len(c.Mounts) == 1 && c.Mounts[0] == "/up=./up,rw" &&
+					time.Duration(c.CGITimeout) == 5*time.Second
+			},
+		},
+		{
+			name: "unset fields keep flags",
+			data: `{"rate": 2.5}`,
+			want: func(c config) bool {
+				return c.Root == "./flag-root" && c.Burst == 10 && c.Rate == 2.5 && c.Mounts[0] == "/m=./flag"
+			},
+		},
+		{name: "unknown field", data: `{"rot": "./site"}`, wantErr: true},
+		{name: "bad duration", data: `{"cgi_timeout": 30}`, wantErr: true},
+		{name: "not JSON", data: `root = "./site"`, wantErr: true},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			file := writeFile(t, dir, "config.json", tc.data)
+			got, err := loadConfig(file, flags)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("Expected error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !tc.want(got) {
+				t.Errorf("Got %+v", got)
+			}
+		})
+	}
+}
+
+func TestConfigBuild(t *testing.T) {
+	root := t.TempDir()
+	htpasswd := testHtpasswd(t)
+
+	testcases := []struct {
+		name    string
+		cfg     config
+		wantErr bool
+	}{
+		{name: "minimal", cfg: config{Root: root}},
+		{
+			name: "everything",
+			cfg: config{Root: root, Hide: "*.bak", Mounts: []string{"/up=" + root + ",rw"},
+				Proxies: []string{"/api=127.0.0.1:9"}, Vhosts: []string{"*.example.com=" + root},
+				Auth: []string{"/up=" + htpasswd}, Rate: 1, RateCIDR: "10.0.0.0/8"},
+		},
+		{name: "bad mount", cfg: config{Root: root, Mounts: []string{"up=" + root}}, wantErr: true},
+		{name: "bad vhost", cfg: config{Root: root, Vhosts: []string{"a*b=" + root}}, wantErr: true},
+		{name: "missing htpasswd", cfg: config{Root: root, Auth: []string{"/a=" + root + "/none"}}, wantErr: true},
+		{name: "bad error page", cfg: config{Root: root, ErrorPages: []string{"200=x.html"}}, wantErr: true},
+		{name: "bad cidr", cfg: config{Root: root, Rate: 1, RateCIDR: "10.0.0.0/99"}, wantErr: true},
+		{name: "bad hide", cfg: config{Root: root, Hide: "[x"}, wantErr: true},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := tc.cfg.build(&server{}, nil)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("Expected error, got %+v", s)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestReload(t *testing.T) {
+	rootA, rootB := t.TempDir(), t.TempDir()
+	writeFile(t, rootA, "which.txt", "A")
+	writeFile(t, rootB, "which.txt", "B")
+	file := filepath.Join(t.TempDir(), "config.json")
+	writeFile(t, filepath.Dir(file), "config.json", `{"root": "`+rootA+`", "max_conns": 100}`)
+
+	base := &server{metrics: newMetrics()}
+	r, s, err := newReloader(file, config{}, base, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limits := s.limits
+	addr := startServer(t, s)
+	if body := get(t, addr, "/which.txt"); !strings.HasSuffix(body, "\r\n\r\nA") {
+		t.Fatalf("Before reload got %q", body)
+	}
+
+	// A connection accepted before the reload is served by the old
+	// config even if its request arrives after.
+	old, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+	waitFor(t, func() bool { return base.metrics.active.Load() == 1 })
+
+	writeFile(t, filepath.Dir(file), "config.json", `{"root": "`+rootB+`", "max_conns": 100}`)
+	if err := r.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if body := get(t, addr, "/which.txt"); !strings.HasSuffix(body, "\r\n\r\nB") {
+		t.Errorf("After reload got %q", body)
+	}
+	if s.current().limits != limits {
+		t.Error("Reload with the same limits replaced the limiter")
+	}
+
+	old.Write([]byte("GET /which.txt HTTP/1.1\r\nHost: test\r\n\r\n"))
+	data, _ := io.ReadAll(old)
+	if !strings.HasSuffix(string(data), "\r\n\r\nA") {
+		t.Errorf("In-flight connection got %q", data)
+	}
+
+	writeFile(t, filepath.Dir(file), "config.json", `{"root": "`+rootA+`", "mount": ["nope"]}`)
+	if err := r.reload(); err == nil {
+		t.Fatal("Expected the bad config to be refused")
+	}
+	if body := get(t, addr, "/which.txt"); !strings.HasSuffix(body, "\r\n\r\nB") {
+		t.Errorf("After a failed reload got %q", body)
+	}
+}
+
+func TestReloadClosesArchives(t *testing.T) {
+	archive := zipBundle(t)
+	file := writeFile(t, t.TempDir(), "config.json", `{"root": "`+archive+`"}`)
+	r, s, err := newReloader(file, config{}, &server{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := startServer(t, s)
+	cfg := s.current()
+	open := func() bool {
+		_, err := fs.ReadFile(cfg.def.files, "index.html")
+		return err == nil
+	}
+
+	// The first config's archive stays open while a connection it
+	// accepted is, then closes with it.
+	old, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+	waitFor(t, func() bool {
+		cfg.conns.mu.Lock()
+		defer cfg.conns.mu.Unlock()
+		return cfg.conns.n == 1
+	})
+	if err := r.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if !open() {
+		t.Fatal("Archive closed under an open connection")
+	}
+	if body := get(t, addr, "/index.html"); !strings.HasSuffix(body, "<h1>docs</h1>") {
+		t.Errorf("After reload got %q", body)
+	}
+	old.Close()
+	waitFor(t, func() bool { return !open() })
+
+	// The second closes once the request served from it is done.
+	cfg = s.current()
+	if err := r.reload(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return !open() })
+}
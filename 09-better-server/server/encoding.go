@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strconv"
+	"strings"
+)
+
+// precompressed lists the sibling files checked before falling back
+// to on the fly gzip, e.g. app.js.br then app.js.gz for app.js.
+var precompressed = []struct{ coding, ext string }{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// Bodies smaller than this are not worth a gzip header and CPU time.
+const minCompressSize = 256
+
+// sendFile writes the file with the best content coding the client
+// accepts: a precompressed sibling when one exists, gzip on the fly
+// for compressible types, or the file as is. A Range applies to the
+// bytes sent, the gzip ones included, so that a client resuming a
+// download joins parts of the same encoding.
+func (s *site) sendFile(b *bytes.Buffer, req *request, m mount, urlPath, name string) {
+	ctype := contentType(name)
+	accept := req.header["Accept-Encoding"]
+
+	for _, pc := range precompressed {
+		if encodingQuality(accept, pc.coding) <= 0 {
+			continue
+		}
+		sibling, err := s.policy.lookup(m, urlPath+pc.ext)
+		if err != nil {
+			continue
+		}
+		data, err := s.cache.readFile(m.files(), sibling, m.path(sibling))
+		if err != nil {
+			continue // missing, or a directory
+		}
+		extra := []string{"Content-Encoding: " + pc.coding, "Vary: Accept-Encoding", "Accept-Ranges: bytes"}
+		if sendRange(b, req, ctype, data, extra...) {
+			return
+		}
+		buildResp(b, "200 OK", ctype, strconv.Itoa(len(data)), extra...)
+		b.Write(data)
+		return
+	}
+
+	data, err := s.cache.readFile(m.files(), name, m.path(name))
+	if err != nil {
+		sendFileError(b, err)
+		return
+	}
+	data, extra := encodeBody(req, ctype, data, "Accept-Ranges: bytes")
+	if sendRange(b, req, ctype, data, extra...) {
+		return
+	}
+	buildResp(b, "200 OK", ctype, strconv.Itoa(len(data)), extra...)
+	b.Write(data)
+}
+
+// sendBody writes a complete response for data, gzipping it when the
+// type is compressible and the client accepts gzip. Content-Length is
+// always that of the bytes actually sent.
+func sendBody(b *bytes.Buffer, req *request, status, ctype string, data []byte, extra ...string) {
+	data, extra = encodeBody(req, ctype, data, extra...)
+	buildResp(b, status, ctype, strconv.Itoa(len(data)), extra...)
+	b.Write(data)
+}
+
+// encodeBody gzips data when the type is compressible and the client
+// accepts gzip, returning the bytes to send and extra with the header
+// fields that go with them added.
+func encodeBody(req *request, ctype string, data []byte, extra ...string) ([]byte, []string) {
+	if !compressible(ctype) {
+		return data, extra
+	}
+	extra = append(extra, "Vary: Accept-Encoding")
+	if len(data) < minCompressSize || encodingQuality(req.header["Accept-Encoding"], "gzip") <= 0 {
+		return data, extra
+	}
+	var z bytes.Buffer
+	zw := gzip.NewWriter(&z)
+	zw.Write(data)
+	zw.Close()
+	if z.Len() >= len(data) {
+		return data, extra
+	}
+	return z.Bytes(), append(extra, "Content-Encoding: gzip")
+}
+
+// compressible reports whether a media type is worth compressing.
+// Images other than SVG and archives are compressed already.
+func compressible(ctype string) bool {
+	mediaType, _, _ := strings.Cut(ctype, ";")
+	switch mediaType {
+	case "application/json", "application/javascript", "image/svg+xml":
+		return true
+	}
+	return strings.HasPrefix(mediaType, "text/")
+}
+
+// encodingQuality returns the q-value Accept-Encoding gives to coding,
+// falling back to the "*" entry. No header means no codings.
+func encodingQuality(accept, coding string) float64 {
+	q, found := 0.0, false
+	for _, field := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(field), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		switch {
+		case name == coding:
+			return parseQ(params)
+		case name == "*" && !found:
+			q, found = parseQ(params), true
+		}
+	}
+	return q
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestEncodingQuality(t *testing.T) {
+	testcases := []struct {
+		accept string
+		coding string
+		q      float64
+	}{
+		{"", "gzip", 0},
+		{"gzip", "gzip", 1},
+		{"gzip;q=0.5, br", "gzip", 0.5},
+		{"GZIP", "gzip", 1},
+		{"br;q=0", "br", 0},
+		{"*", "br", 1},
+		{"*;q=0.2, gzip;q=0", "gzip", 0},
+		{"deflate", "gzip", 0},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.accept+"/"+tc.coding, func(t *testing.T) {
+			if got := encodingQuality(tc.accept, tc.coding); got != tc.q {
+				t.Errorf("Got %v, want %v", got, tc.q)
+			}
+		})
+	}
+}
+
+func TestContentEncoding(t *testing.T) {
+	root := t.TempDir()
+	page := strings.Repeat("<p>hello, compressible world</p>\n", 64)
+	files := map[string]string{
+		"page.html": page,
+		"app.js":    "console.log('plain')",
+		"app.js.gz": "pretend gzip",
+		"app.js.br": "pretend brotli",
+		"tiny.txt":  "small",
+		"photo.jpg": strings.Repeat("x", 1024),
+		"data.bin":  strings.Repeat("x", 1024),
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := &server{def: &site{root: root, policy: policy{strict: true}}}
+
+	testcases := []struct {
+		path     string
+		accept   string
+		encoding string
+		vary     bool
+		body     string
+	}{
+		{"/page.html", "gzip, br", "gzip", true, page},
+		{"/page.html", "", "", true, page},
+		{"/page.html", "gzip;q=0", "", true, page},
+		{"/app.js", "gzip, br", "br", true, "pretend brotli"},
+		{"/app.js", "gzip", "gzip", true, ""},
+		{"/app.js", "", "", true, "console.log('plain')"},
+		{"/tiny.txt", "gzip", "", true, "small"},
+		{"/photo.jpg", "gzip", "", false, strings.Repeat("x", 1024)},
+		{"/data.bin", "gzip", "", false, strings.Repeat("x", 1024)},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.path+"/"+tc.accept, func(t *testing.T) {
+			raw := "GET " + tc.path + " HTTP/1.1\r\nHost: test\r\n"
+			if tc.accept != "" {
+				raw += "Accept-Encoding: " + tc.accept + "\r\n"
+			}
+			resp := roundTrip(t, s, raw+"\r\n")
+			head, body, _ := strings.Cut(resp, "\r\n\r\n")
+
+			if got := headerValue(head, "Content-Encoding"); got != tc.encoding {
+				t.Errorf("Content-Encoding: got %q, want %q", got, tc.encoding)
+			}
+			if got := headerValue(head, "Vary") == "Accept-Encoding"; got != tc.vary {
+				t.Errorf("Vary: Accept-Encoding present %v, want %v", got, tc.vary)
+			}
+			if clen, _ := strconv.Atoi(headerValue(head, "Content-Length")); clen != len(body) {
+				t.Errorf("Content-Length %d, body is %d bytes", clen, len(body))
+			}
+
+			if tc.encoding == "gzip" && tc.body != "" {
+				zr, err := gzip.NewReader(bytes.NewReader([]byte(body)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				plain, _ := io.ReadAll(zr)
+				body = string(plain)
+			}
+			if tc.body != "" && body != tc.body {
+				t.Errorf("Body mismatch! Got %d bytes, want %d", len(body), len(tc.body))
+			}
+		})
+	}
+}
+
+// A client resuming a gzipped download, as curl -C - does, gets the
+// rest of the same gzip bytes, not of the file as is.
+func TestGzipRange(t *testing.T) {
+	root := t.TempDir()
+	page := strings.Repeat("<p>hello, compressible world</p>\n", 64)
+	writeFile(t, root, "page.html", page)
+	s := &server{def: &site{root: root}}
+
+	resp := roundTrip(t, s, "GET /page.html HTTP/1.1\r\nHost: test\r\nAccept-Encoding: gzip\r\n\r\n")
+	_, whole, _ := strings.Cut(resp, "\r\n\r\n")
+	half := len(whole) / 2
+
+	resp = roundTrip(t, s, "GET /page.html HTTP/1.1\r\nHost: test\r\nAccept-Encoding: gzip\r\n"+
+		"Range: bytes="+strconv.Itoa(half)+"-\r\n\r\n")
+	head, rest, _ := strings.Cut(resp, "\r\n\r\n")
+	if got := firstLine(resp); got != "HTTP/1.1 206 Partial Content" {
+		t.Fatalf("Got %q, want 206", got)
+	}
+	if got := headerValue(head, "Content-Encoding"); got != "gzip" {
+		t.Errorf("Content-Encoding: got %q, want gzip", got)
+	}
+	want := "bytes " + strconv.Itoa(half) + "-" + strconv.Itoa(len(whole)-1) + "/" + strconv.Itoa(len(whole))
+	if got := headerValue(head, "Content-Range"); got != want {
+		t.Errorf("Content-Range: got %q, want %q", got, want)
+	}
+
+	zr, err := gzip.NewReader(strings.NewReader(whole[:half] + rest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain, err := io.ReadAll(zr); err != nil || string(plain) != page {
+		t.Errorf("Joined parts decode to %d bytes, %v; want the %d byte page", len(plain), err, len(page))
+	}
+}
+
+func TestContentType(t *testing.T) {
+	testcases := []struct {
+		path         string
+		ctype        string // "" when it depends on the system's mime.types
+		compressible bool
+	}{
+		{"index.html", "text/html", true},
+		{"notes.txt", "text/plain", true},
+		{"app.js", "application/javascript", true},
+		{"logo.svg", "image/svg+xml", true},
+		{"photo.jpg", "image/jpeg", false},
+		{"photo.png", "image/png", false},
+		{"paper.pdf", "application/pdf", false},
+		{"site.zip", "", false},
+		{"notes.txt.gz", "", false},
+		{"Makefile", "application/octet-stream", false},
+		{"blob.unknown-ext", "application/octet-stream", false},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.path, func(t *testing.T) {
+			got := contentType(tc.path)
+			if tc.ctype != "" && got != tc.ctype {
+				t.Errorf("Got %q, want %q", got, tc.ctype)
+			}
+			if compressible(got) != tc.compressible {
+				t.Errorf("Got compressible %v, want %v", compressible(got), tc.compressible)
+			}
+		})
+	}
+}
+
+// headerValue returns the first value of a header field in a raw
+// response head.
+func headerValue(head, name string) string {
+	for _, line := range strings.Split(head, "\r\n") {
+		k, v, ok := strings.Cut(line, ":")
+		if ok && strings.EqualFold(k, name) {
+			return strings.TrimSpace(v)
+		}
+	}
+	return ""
+}
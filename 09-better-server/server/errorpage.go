@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// errorPages holds the pages configured for error status codes.
+type errorPages map[int]*errorPage
+
+// errorPage is a static file or, when its name ends in .tmpl, an
+// html/template executed with an errorData.
+type errorPage struct {
+	ctype  string
+	static []byte
+	tmpl   *template.Template
+}
+
+// errorData is what error templates and JSON errors see.
+type errorData struct {
+	Code      int    `json:"status"`
+	Status    string `json:"error"` // e.g. "404 File not found"
+	Path      string `json:"path"`
+	RequestID string `json:"request_id"`
+}
+
+func loadErrorPage(file string) (*errorPage, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	name, isTmpl := strings.CutSuffix(file, ".tmpl")
+	p := &errorPage{ctype: contentType(name)}
+	if !isTmpl {
+		p.static = data
+		return p, nil
+	}
+	p.tmpl, err = template.New(file).Parse(string(data))
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// render dresses up an error response sendError left in b: clients
+// preferring JSON get a JSON object, others the page configured for
+// the status code, if any. Other header fields are kept. Responses
+// that are not a bare sendError, such as files and relayed upstream
+// errors, are left alone. req is nil when the request didn't parse.
+func (pages errorPages) render(b *bytes.Buffer, req *request) {
+	// Look at the status line alone first: b may hold a whole file,
+	// which must not be copied on every request.
+	raw := b.Bytes()
+	statusLine, _, _ := bytes.Cut(raw[:min(len(raw), 128)], []byte("\r\n"))
+	status, ok := strings.CutPrefix(string(statusLine), "HTTP/1.1 ")
+	code, _ := strconv.Atoi(status[:min(3, len(status))])
+	if !ok || code < 400 {
+		return
+	}
+	end := bytes.Index(raw, []byte("\r\n\r\n"))
+	if end < 0 || string(raw[end+4:]) != status {
+		return
+	}
+	lines := strings.Split(string(raw[:end]), "\r\n")
+
+	var accept string
+	d := errorData{Code: code, Status: status}
+	if req != nil {
+		accept = req.header["Accept"]
+		d.Path = req.path
+		d.RequestID = requestID(req.header["X-Request-Id"])
+	} else {
+		d.RequestID = requestID("")
+	}
+
+	var out bytes.Buffer
+	page := pages[code]
+	offer := "text/plain"
+	if page != nil {
+		offer = page.ctype
+	}
+	switch {
+	case preferredType(accept, offer, "application/json") == "application/json":
+		json.NewEncoder(&out).Encode(d)
+		offer = "application/json"
+	case page == nil:
+		return
+	case page.tmpl != nil:
+		if err := page.tmpl.Execute(&out, d); err != nil {
+			log.Printf("Error page %d: %v", code, err)
+			return
+		}
+	default:
+		out.Write(page.static)
+	}
+
+	extra := []string{"Vary: Accept", "X-Request-Id: " + d.RequestID}
+	for _, line := range lines[1:] {
+		name, _, _ := strings.Cut(line, ":")
+		switch name {
+		case "Content-Type", "Content-Length", "Connection":
+			continue
+		}
+		extra = append(extra, line)
+	}
+	b.Reset()
+	buildResp(b, status, offer, strconv.Itoa(out.Len()), extra...)
+	out.WriteTo(b)
+}
+
+// requestID returns the client's X-Request-Id when it looks like an
+// ID, so errors can be matched up with a front proxy's logs, and a
+// fresh random one otherwise.
+func requestID(given string) string {
+	if len(given) > 0 && len(given) <= 64 && strings.Trim(given,
+		"abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_.") == "" {
+		return given
+	}
+	var id [8]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// errorPageFlag collects repeated -error-page code=file flags.
+type errorPageFlag errorPages
+
+func (f *errorPageFlag) String() string {
+	var codes []string
+	for code := range *f {
+		codes = append(codes, strconv.Itoa(code))
+	}
+	return strings.Join(codes, ",")
+}
+
+func (f *errorPageFlag) Set(v string) error {
+	codeStr, file, ok := strings.Cut(v, "=")
+	code, err := strconv.Atoi(codeStr)
+	if !ok || err != nil || code < 400 || code > 599 || file == "" {
+		return fmt.Errorf("want code=file with a 4xx or 5xx code, got %q", v)
+	}
+	page, err := loadErrorPage(file)
+	if err != nil {
+		return err
+	}
+	if *f == nil {
+		*f = make(errorPageFlag)
+	}
+	(*f)[code] = page
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestErrorPages(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, root, "a.txt", "a")
+	pageDir := t.TempDir()
+
+	var pages errorPageFlag
+	for _, v := range []string{
+		"404=" + writeFile(t, pageDir, "404.html.tmpl",
+			`<p>{{.Path}} is gone ({{.Code}}, {{.RequestID}})</p>`),
+		"405=" + writeFile(t, pageDir, "405.html", "<p>not here</p>"),
+	} {
+		if err := pages.Set(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := &server{def: &site{root: root}, errorPages: errorPages(pages)}
+
+	testcases := []struct {
+		name   string
+		req    string
+		ctype  string
+		body   string
+		custom bool
+	}{
+		{"template", "GET /%3Cb%3E HTTP/1.1\r\nHost: t\r\nX-Request-Id: abc-123\r\n\r\n",
+			"text/html", "<p>/&lt;b&gt; is gone (404, abc-123)</p>", true},
+		{"static", "POST /a.txt HTTP/1.1\r\nHost: t\r\n\r\n",
+			"text/html", "<p>not here</p>", true},
+		{"success", "GET /a.txt HTTP/1.0\r\nAccept: text/html\r\n\r\nx", "text/plain", "a", false},
+		{"unconfigured", "GET / HTTP/1.1\r\n\r\n", "text/plain", "400 Bad Request", false},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := roundTrip(t, s, tc.req)
+			if got := headerValue(resp, "Content-Type"); got != tc.ctype {
+				t.Errorf("Content-Type %q, want %q", got, tc.ctype)
+			}
+			if _, body, _ := strings.Cut(resp, "\r\n\r\n"); body != tc.body {
+				t.Errorf("Body %q, want %q", body, tc.body)
+			}
+			if got := headerValue(resp, "X-Request-Id") != ""; got != tc.custom {
+				t.Errorf("X-Request-Id set %v, want %v", got, tc.custom)
+			}
+		})
+	}
+}
+
+func TestRenderLeavesFilesAlone(t *testing.T) {
+	req := &request{path: "/big.bin", header: map[string]string{"Accept": "application/json"}}
+	big := strings.Repeat("x", 1<<20)
+	for _, status := range []string{"200 OK", "404 File not found"} {
+		t.Run(status, func(t *testing.T) {
+			var b bytes.Buffer
+			buildResp(&b, status, "application/octet-stream", strconv.Itoa(len(big)))
+			b.WriteString(big)
+			want := b.String()
+
+			// A copy of the response per call would be 10 MiB.
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			for range 10 {
+				errorPages{}.render(&b, req)
+			}
+			runtime.ReadMemStats(&after)
+			if n := after.TotalAlloc - before.TotalAlloc; n > 64<<10 {
+				t.Errorf("Allocated %d bytes rendering", n)
+			}
+			if b.String() != want {
+				t.Error("Response changed")
+			}
+		})
+	}
+}
+
+func TestJSONErrors(t *testing.T) {
+	users, err := loadHtpasswd(testHtpasswd(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server{def: &site{
+		root: t.TempDir(),
+		auth: []authRule{{prefix: "/private/", realm: "x", users: users}},
+	}}
+
+	resp := roundTrip(t, s, "GET /missing HTTP/1.1\r\nHost: t\r\nAccept: application/json\r\n\r\n")
+	if got := headerValue(resp, "Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type %q", got)
+	}
+	_, body, _ := strings.Cut(resp, "\r\n\r\n")
+	var d errorData
+	if err := json.Unmarshal([]byte(body), &d); err != nil {
+		t.Fatalf("%v in %q", err, body)
+	}
+	if d.Code != 404 || d.Status != "404 File not found" || d.Path != "/missing" || d.RequestID == "" {
+		t.Errorf("Got %+v", d)
+	}
+	if d.RequestID != headerValue(resp, "X-Request-Id") {
+		t.Errorf("Body ID %q, header %q", d.RequestID, headerValue(resp, "X-Request-Id"))
+	}
+
+	// Header fields of the original answer survive.
+	resp = roundTrip(t, s, "GET /private/ HTTP/1.1\r\nHost: t\r\nAccept: application/json\r\n\r\n")
+	if !strings.HasPrefix(resp, "HTTP/1.1 401 ") || headerValue(resp, "WWW-Authenticate") == "" {
+		t.Errorf("Got %q", resp)
+	}
+	if got := headerValue(resp, "Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type %q", got)
+	}
+}
+
+func TestErrorPageFlag(t *testing.T) {
+	dir := t.TempDir()
+	page := writeFile(t, dir, "500.html", "oops")
+	var f errorPageFlag
+	for _, v := range []string{"200=" + page, "abc=" + page, "404=", "404=" + filepath.Join(dir, "none")} {
+		if err := f.Set(v); err == nil {
+			t.Errorf("Set(%q) succeeded", v)
+		}
+	}
+	if err := f.Set("500=" + page); err != nil || f[500] == nil {
+		t.Errorf("Set failed: %v", err)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+)
+
+// answer builds the complete response to a raw request head in resp
+// for the event loop, which can only send what fits in a buffer.
+func (s *server) answer(resp *bytes.Buffer, head []byte) {
+	req, err := parseReq(bytes.NewReader(head))
+	switch {
+	case errors.Is(err, errHeadTooLarge):
+		sendError(resp, "431 Request Header Fields Too Large")
+	case err != nil:
+		sendError(resp, "400 Bad Request")
+	default:
+		s.answerReq(resp, req)
+	}
+	s.errorPages.render(resp, req)
+}
+
+func (s *server) answerReq(b *bytes.Buffer, req *request) {
+	if s.metrics != nil && req.method == "GET" && req.path == s.metricsPath {
+		s.sendMetrics(b)
+		return
+	}
+	site := s.siteFor(req)
+	if site == nil {
+		sendError(b, "400 Bad Request")
+		return
+	}
+	if !site.authorized(b, req) {
+		return
+	}
+	if m, _ := site.locate(req.path); m.proxy != nil || m.cgi {
+		sendError(b, "501 Not Implemented")
+		return
+	}
+	if req.method != "GET" {
+		sendError(b, "405 Method Not Allowed")
+		return
+	}
+	site.servePath(b, req)
+}
@@ -0,0 +1,281 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// eventLoop serves the file server from one goroutine, in the manner
+// of Beej's select chapter: every socket is non-blocking and an epoll
+// readiness loop moves each connection through its states, reading
+// the request head, then writing the answer, then closing.
+//
+// It answers what can be answered from a buffer: files, listings and
+// errors. Proxy and CGI mounts, uploads, events and WebSockets hold a
+// connection open or stream a body and are left to the goroutine per
+// connection server. The disk is still read synchronously. Like that
+// server it holds clients to the limits and counts connections in the
+// metrics.
+type eventLoop struct {
+	s     *server
+	lfile *os.File // keeps the listener's duplicated descriptor alive
+	lfd   int
+	epfd  int
+	wake  [2]int // a write to wake[1] stops the loop
+	conns map[int]*loopConn
+	buf   []byte // shared read buffer, there is only one goroutine
+}
+
+// loopConn is one connection's state between readiness events.
+type loopConn struct {
+	s       *server // the config current when it was accepted
+	in      []byte  // request head read so far
+	out     []byte  // answer left to write, nil while still reading
+	writing bool
+
+	key      string        // the client's key under s.limits
+	admitted bool          // holds a slot in s.limits until closed
+	retry    time.Duration // for a client over its limits, answered 429
+
+	// For s.metrics, as meteredConn keeps them.
+	start        time.Time
+	method, code string
+	read, sent   int64
+}
+
+func (s *server) newEventLoop(ln net.Listener) (*eventLoop, error) {
+	tl, ok := ln.(*net.TCPListener)
+	if !ok {
+		return nil, errors.New("event loop needs a TCP listener")
+	}
+	lfile, err := tl.File()
+	if err != nil {
+		return nil, err
+	}
+	l := &eventLoop{s: s, lfile: lfile, lfd: int(lfile.Fd()), epfd: -1, wake: [2]int{-1, -1},
+		conns: make(map[int]*loopConn), buf: make([]byte, 4096)}
+	if err := syscall.SetNonblock(l.lfd, true); err != nil {
+		lfile.Close()
+		return nil, err
+	}
+
+	l.epfd, err = syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		lfile.Close()
+		return nil, err
+	}
+	err = syscall.Pipe2(l.wake[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC)
+	if err == nil {
+		err = l.watch(syscall.EPOLL_CTL_ADD, l.lfd, syscall.EPOLLIN)
+	}
+	if err == nil {
+		err = l.watch(syscall.EPOLL_CTL_ADD, l.wake[0], syscall.EPOLLIN)
+	}
+	if err != nil {
+		l.closeAll()
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *eventLoop) watch(op, fd int, events uint32) error {
+	ev := syscall.EpollEvent{Events: events, Fd: int32(fd)}
+	return syscall.EpollCtl(l.epfd, op, fd, &ev)
+}
+
+// stop makes run return. It may be called from any goroutine.
+func (l *eventLoop) stop() {
+	syscall.Write(l.wake[1], []byte{0})
+}
+
+// run serves connections until stop is called.
+func (l *eventLoop) run() error {
+	defer l.closeAll()
+	events := make([]syscall.EpollEvent, 256)
+	for {
+		n, err := syscall.EpollWait(l.epfd, events, -1)
+		if errors.Is(err, syscall.EINTR) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, ev := range events[:n] {
+			switch fd := int(ev.Fd); fd {
+			case l.wake[0]:
+				return nil
+			case l.lfd:
+				l.accept()
+			default:
+				l.ready(fd, ev.Events)
+			}
+		}
+	}
+}
+
+// accept takes every pending connection off the listener.
+func (l *eventLoop) accept() {
+	for {
+		fd, sa, err := syscall.Accept4(l.lfd, syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC)
+		if errors.Is(err, syscall.EAGAIN) {
+			return
+		}
+		if errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.ECONNABORTED) {
+			continue
+		}
+		if err != nil {
+			log.Print(err)
+			if l.s.metrics != nil {
+				l.s.metrics.acceptErrors.Add(1)
+			}
+			return
+		}
+		if err := l.watch(syscall.EPOLL_CTL_ADD, fd, syscall.EPOLLIN|syscall.EPOLLRDHUP); err != nil {
+			log.Print(err)
+			syscall.Close(fd)
+			continue
+		}
+		c := &loopConn{s: l.s.acquire(), start: time.Now()}
+		if c.s.metrics != nil {
+			c.s.metrics.active.Add(1)
+		}
+		if c.s.limits != nil {
+			c.key = c.s.limits.clientKey(sockaddrAddr(sa))
+			c.retry, c.admitted = c.s.limits.admit(c.key)
+		}
+		l.conns[fd] = c
+	}
+}
+
+// sockaddrAddr turns what accept returns into the net.Addr a net.Conn
+// would report.
+func sockaddrAddr(sa syscall.Sockaddr) net.Addr {
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return &net.TCPAddr{IP: net.IPv4(sa.Addr[0], sa.Addr[1], sa.Addr[2], sa.Addr[3]), Port: sa.Port}
+	case *syscall.SockaddrInet6:
+		return &net.TCPAddr{IP: append(net.IP(nil), sa.Addr[:]...), Port: sa.Port}
+	}
+	return &net.TCPAddr{}
+}
+
+// ready advances a connection the kernel reported ready.
+func (l *eventLoop) ready(fd int, events uint32) {
+	c := l.conns[fd]
+	if c == nil {
+		return
+	}
+	if events&syscall.EPOLLERR != 0 {
+		l.closeConn(fd)
+		return
+	}
+	if !c.writing {
+		l.read(fd, c)
+		return
+	}
+	l.write(fd, c)
+}
+
+// read gathers the request head. Once it is complete the answer is
+// built, or a 429 for a client over its limits, and writing starts;
+// the peer hanging up first closes. Unlike sendTooMany the loop reads
+// the head of a refused request before answering, so that closing
+// doesn't reset the connection under the client.
+func (l *eventLoop) read(fd int, c *loopConn) {
+	for {
+		n, err := syscall.Read(fd, l.buf)
+		if errors.Is(err, syscall.EAGAIN) {
+			return
+		}
+		if errors.Is(err, syscall.EINTR) {
+			continue
+		}
+		if err != nil || n == 0 {
+			l.closeConn(fd)
+			return
+		}
+		c.in = append(c.in, l.buf[:n]...)
+		c.read += int64(n)
+		if c.method == "" {
+			c.method = requestMethod(c.in)
+		}
+
+		complete := bytes.Contains(c.in, []byte("\r\n\r\n")) || bytes.Contains(c.in, []byte("\n\n"))
+		if !complete && len(c.in) <= maxHead {
+			continue
+		}
+		var b bytes.Buffer
+		switch {
+		case c.s.limits != nil && !c.admitted:
+			buildTooMany(&b, c.retry)
+		case complete:
+			c.s.answer(&b, c.in)
+		default:
+			sendError(&b, "431 Request Header Fields Too Large")
+		}
+		c.out = b.Bytes()
+		c.in, c.writing = nil, true
+		l.write(fd, c)
+		return
+	}
+}
+
+// write sends as much of the answer as the socket takes, waiting for
+// EPOLLOUT when it is full, and closes once all is sent.
+func (l *eventLoop) write(fd int, c *loopConn) {
+	for len(c.out) > 0 {
+		n, err := syscall.Write(fd, c.out)
+		if errors.Is(err, syscall.EAGAIN) {
+			if err := l.watch(syscall.EPOLL_CTL_MOD, fd, syscall.EPOLLOUT); err != nil {
+				l.closeConn(fd)
+			}
+			return
+		}
+		if errors.Is(err, syscall.EINTR) {
+			continue
+		}
+		if err != nil {
+			l.closeConn(fd)
+			return
+		}
+		if c.sent == 0 {
+			c.code = statusCode(c.out)
+		}
+		c.sent += int64(n)
+		c.out = c.out[n:]
+	}
+	// Connection: close, the client reads to EOF
+	syscall.Shutdown(fd, syscall.SHUT_WR)
+	l.closeConn(fd)
+}
+
+func (l *eventLoop) closeConn(fd int) {
+	syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_DEL, fd, nil)
+	syscall.Close(fd)
+	c := l.conns[fd]
+	delete(l.conns, fd)
+	defer c.s.conns.release()
+	if c.admitted {
+		c.s.limits.release(c.key)
+	}
+	if c.s.metrics != nil {
+		c.s.metrics.finish(c.method, c.code, c.read, c.sent, c.start)
+	}
+}
+
+func (l *eventLoop) closeAll() {
+	for fd := range l.conns {
+		l.closeConn(fd)
+	}
+	syscall.Close(l.epfd)
+	syscall.Close(l.wake[0])
+	syscall.Close(l.wake[1])
+	l.lfile.Close()
+}
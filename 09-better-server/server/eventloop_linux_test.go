@@ -0,0 +1,202 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+
+	"io"
+	"net"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// startLoop serves s from an event loop on a loopback port until the
+// test ends.
+func startLoop(t testing.TB, s *server) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	loop, err := s.newEventLoop(ln)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		loop.run()
+		close(done)
+	}()
+	t.Cleanup(func() {
+		loop.stop()
+		<-done
+		ln.Close()
+	})
+	return ln.Addr().String()
+}
+
+func TestEventLoop(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, root, "a.txt", "hello")
+	big := strings.Repeat("0123456789abcdef", 1<<18) // 4 MiB, more than a socket buffer
+	writeFile(t, root, "big.bin", big)
+	addr := startLoop(t, &server{def: &site{root: root}})
+
+	testcases := []struct {
+		req    string
+		status string
+		body   string
+	}{
+		{"GET /a.txt HTTP/1.1\r\nHost: t\r\n\r\n", "200 OK", "hello"},
+		{"GET /a.txt HTTP/1.0\n\n", "200 OK", "hello"},
+		{"GET /missing HTTP/1.1\r\nHost: t\r\n\r\n", "404 File not found", "404 File not found"},
+		{"PUT /a.txt HTTP/1.1\r\nHost: t\r\nContent-Length: 1\r\n\r\nx", "405 Method Not Allowed", "405 Method Not Allowed"},
+		{"nonsense\r\n\r\n", "400 Bad Request", "400 Bad Request"},
+		{"GET /big.bin HTTP/1.1\r\nHost: t\r\n\r\n", "200 OK", big},
+	}
+	for _, tc := range testcases {
+		t.Run(firstLine(tc.req), func(t *testing.T) {
+			c, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			c.SetDeadline(time.Now().Add(5 * time.Second))
+			// Byte by byte, so the head arrives over many reads.
+			for i := range len(tc.req) {
+				c.Write([]byte{tc.req[i]})
+			}
+			resp, err := io.ReadAll(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := firstLine(string(resp)); got != "HTTP/1.1 "+tc.status {
+				t.Errorf("Got %q, want %q", got, tc.status)
+			}
+			if _, body, _ := bytes.Cut(resp, []byte("\r\n\r\n")); string(body) != tc.body {
+				t.Errorf("Got %d body bytes, want %d", len(body), len(tc.body))
+			}
+		})
+	}
+}
+
+func TestEventLoopOversizedHead(t *testing.T) {
+	addr := startLoop(t, &server{def: &site{root: t.TempDir()}})
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	go c.Write([]byte("GET / HTTP/1.1\r\nX: " + strings.Repeat("x", maxHead+1)))
+	resp, _ := io.ReadAll(c)
+	if !strings.HasPrefix(string(resp), "HTTP/1.1 431 ") {
+		t.Errorf("Got %q, want 431", firstLine(string(resp)))
+	}
+}
+
+// The loop holds clients to the same limits and counts the same
+// metrics as the goroutine per connection server.
+
+func TestEventLoopRateLimit(t *testing.T) {
+	testRateLimitManyClients(t, startLoop)
+}
+
+func TestEventLoopConnectionCaps(t *testing.T) {
+	testConnectionCaps(t, startLoop)
+}
+
+func TestEventLoopMetrics(t *testing.T) {
+	testMetrics(t, startLoop)
+}
+
+// idleConnCount is how many idle connections the benchmarks hold
+// open: 10k, unless the descriptor limit can't take both ends of them
+// in one process.
+func idleConnCount() int {
+	var lim syscall.Rlimit
+	syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim)
+	lim.Cur = lim.Max
+	syscall.Setrlimit(syscall.RLIMIT_NOFILE, &lim)
+	return min(10000, int(lim.Cur-512)/2)
+}
+
+// BenchmarkIdleConns compares the goroutine per connection server with
+// the event loop while thousands of idle clients are connected. It
+// reports the memory each idle connection costs, both its ends as the
+// clients live in the same process, and the time to serve a small
+// file next to them.
+func BenchmarkIdleConns(b *testing.B) {
+	root := b.TempDir()
+	writeFile(b, root, "small.txt", strings.Repeat("x", 1<<10))
+	n := idleConnCount()
+
+	variants := []struct {
+		name  string
+		start func(testing.TB, *server) string
+	}{
+		{"goroutines", startServer},
+		{"epoll", startLoop},
+	}
+	for _, v := range variants {
+		b.Run(v.name, func(b *testing.B) {
+			addr := v.start(b, &server{def: &site{root: root}})
+
+			var before, after runtime.MemStats
+			settle()
+			runtime.ReadMemStats(&before)
+			idle := make([]net.Conn, 0, n)
+			for range n {
+				c, err := net.Dial("tcp", addr)
+				if err != nil {
+					b.Fatal(err)
+				}
+				idle = append(idle, c)
+			}
+			// Let the goroutine server's handlers exit, so that the next
+			// variant's baseline doesn't shrink under it.
+			goroutines := runtime.NumGoroutine()
+			defer func() {
+				for _, c := range idle {
+					c.Close()
+				}
+				deadline := time.Now().Add(10 * time.Second)
+				for runtime.NumGoroutine() > goroutines && time.Now().Before(deadline) {
+					time.Sleep(10 * time.Millisecond)
+				}
+			}()
+			// Connections are accepted in order, so once this one is
+			// answered the server holds all the idle ones.
+			if resp := get(b, addr, "/small.txt"); !strings.HasPrefix(resp, "HTTP/1.1 200 ") {
+				b.Fatalf("Got %q", firstLine(resp))
+			}
+			settle()
+			runtime.ReadMemStats(&after)
+			inUse := func(m *runtime.MemStats) float64 {
+				return float64(m.HeapInuse + m.StackInuse)
+			}
+
+			for b.Loop() {
+				get(b, addr, "/small.txt")
+			}
+			// Reported last, as the timer reset by b.Loop drops them.
+			b.ReportMetric((inUse(&after)-inUse(&before))/float64(n), "B/idle-conn")
+			b.ReportMetric(float64(n), "idle-conns")
+		})
+	}
+}
+
+// settle collects garbage until what the previous variant left
+// behind is gone: closed connections are only freed the cycle after
+// their finalizers ran, and dead goroutines' stacks a cycle later.
+func settle() {
+	for range 3 {
+		runtime.GC()
+	}
+	debug.FreeOSMemory()
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// eventLoop is only implemented on Linux, where epoll is.
+type eventLoop struct{}
+
+func (s *server) newEventLoop(ln net.Listener) (*eventLoop, error) {
+	return nil, errors.New("the event loop needs Linux epoll")
+}
+
+func (l *eventLoop) run() error { return nil }
+
+func (l *eventLoop) stop() {}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// event is one change pushed to subscribers, e.g. a file PUT or
+// DELETEd through a writable mount.
+type event struct {
+	ID   uint64 `json:"id"`
+	Type string `json:"event"`
+	Data string `json:"data"` // the path changed
+	site *site  // whose auth rules cover Data; nil for none
+}
+
+// eventHub keeps the last keep events so that a client coming back
+// with Last-Event-ID, or long-polling with ?after=, misses nothing
+// that happened while it was away. Waiters block on wake, which is
+// closed and replaced on every publish.
+type eventHub struct {
+	keep        int
+	retry       time.Duration // reconnect delay suggested to SSE clients
+	heartbeat   time.Duration // comment sent on idle streams
+	pollTimeout time.Duration // longest a long-poll is held open
+
+	mu     sync.Mutex
+	nextID uint64
+	recent []event
+	wake   chan struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{
+		keep:        256,
+		retry:       3 * time.Second,
+		heartbeat:   15 * time.Second,
+		pollTimeout: 25 * time.Second,
+		nextID:      1,
+		wake:        make(chan struct{}),
+	}
+}
+
+// publish records an event about path on site from and wakes every
+// waiting subscriber. It is a no-op on a nil hub.
+func (h *eventHub) publish(from *site, typ, path string) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.recent = append(h.recent, event{ID: h.nextID, Type: typ, Data: path, site: from})
+	h.nextID++
+	if len(h.recent) > h.keep {
+		h.recent = h.recent[len(h.recent)-h.keep:]
+	}
+	close(h.wake)
+	h.wake = make(chan struct{})
+}
+
+// since returns the retained events after id and a channel that is
+// closed when the next one is published.
+func (h *eventHub) since(id uint64) ([]event, <-chan struct{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var evs []event
+	for _, ev := range h.recent {
+		if ev.ID > id {
+			evs = append(evs, ev)
+		}
+	}
+	return evs, h.wake
+}
+
+// serveEvents answers on the events path: an SSE stream for clients
+// accepting text/event-stream, a long-poll otherwise. Like any path
+// it is subject to the auth rules of the site it was asked of; past
+// those, a client only hears about paths of that site it could read
+// itself.
+func (s *server) serveEvents(c net.Conn, b *bytes.Buffer, req *request, site *site) {
+	f := newEventFilter(site, req)
+	if preferredType(req.header["Accept"], "application/json", "text/event-stream") == "text/event-stream" {
+		last, _ := strconv.ParseUint(req.header["Last-Event-Id"], 10, 64)
+		s.events.stream(c, last, f)
+		return
+	}
+	q, _ := url.ParseQuery(req.query)
+	after, _ := strconv.ParseUint(q.Get("after"), 10, 64)
+	s.events.poll(b, req, after, f)
+}
+
+// eventFilter hides events about other sites than the subscriber's
+// and about paths under an auth rule its credentials don't pass.
+// Verdicts are kept per rule, so a stream checks a password once
+// rather than on every event.
+type eventFilter struct {
+	root           string // of the subscriber's site
+	user, password string
+	hasCreds       bool
+	verdicts       map[*authRule]bool
+}
+
+func newEventFilter(s *site, req *request) *eventFilter {
+	f := &eventFilter{root: s.root, verdicts: make(map[*authRule]bool)}
+	var err error
+	f.user, f.password, err = basicCredentials(req.header["Authorization"])
+	f.hasCreds = err == nil
+	return f
+}
+
+func (f *eventFilter) allows(ev event) bool {
+	if ev.site == nil {
+		return true
+	}
+	// Sites are told apart by root, as a reload builds new ones for
+	// the same trees while streams opened before it go on.
+	if ev.site.root != f.root {
+		return false
+	}
+	rule := ev.site.authFor(ev.Data)
+	if rule == nil {
+		return true
+	}
+	ok, seen := f.verdicts[rule]
+	if !seen {
+		ok = f.hasCreds && rule.users.check(f.user, f.password)
+		f.verdicts[rule] = ok
+	}
+	return ok
+}
+
+// visible returns the events f allows.
+func (f *eventFilter) visible(evs []event) []event {
+	var out []event
+	for _, ev := range evs {
+		if f.allows(ev) {
+			out = append(out, ev)
+		}
+	}
+	return out
+}
+
+// stream writes events to c as they are published, starting after
+// last, until a write fails because the client went away. Idle
+// streams get a comment line every heartbeat, which also notices a
+// vanished client and keeps proxies from timing the connection out.
+func (h *eventHub) stream(c net.Conn, last uint64, f *eventFilter) {
+	var b bytes.Buffer
+	b.WriteString("HTTP/1.1 200 OK\r\n" +
+		"Content-Type: text/event-stream\r\n" +
+		"Cache-Control: no-cache\r\n" +
+		"Connection: close\r\n\r\n")
+	fmt.Fprintf(&b, "retry: %d\n\n", h.retry.Milliseconds())
+
+	heartbeat := time.NewTicker(h.heartbeat)
+	defer heartbeat.Stop()
+	for {
+		evs, wake := h.since(last)
+		for _, ev := range evs {
+			if f.allows(ev) {
+				writeEvent(&b, ev)
+			}
+			last = ev.ID
+		}
+		if b.Len() > 0 {
+			if _, err := b.WriteTo(c); err != nil {
+				return
+			}
+			heartbeat.Reset(h.heartbeat)
+		}
+		select {
+		case <-wake:
+		case <-heartbeat.C:
+			b.WriteString(": heartbeat\n\n")
+		}
+	}
+}
+
+// writeEvent renders ev as an SSE frame. Data spanning several lines
+// becomes several data fields, which the client joins back up.
+func writeEvent(b *bytes.Buffer, ev event) {
+	fmt.Fprintf(b, "id: %d\nevent: %s\n", ev.ID, ev.Type)
+	for _, line := range strings.Split(ev.Data, "\n") {
+		b.WriteString("data: " + line + "\n")
+	}
+	b.WriteString("\n")
+}
+
+// poll answers with the events after id that f allows as JSON,
+// waiting up to pollTimeout for one to happen. The client passes the
+// returned last_id as ?after= on its next poll; it moves past hidden
+// events too, so they aren't looked at again.
+func (h *eventHub) poll(b *bytes.Buffer, req *request, after uint64, f *eventFilter) {
+	resp := struct {
+		Events []event `json:"events"`
+		LastID uint64  `json:"last_id"`
+	}{Events: []event{}, LastID: after}
+
+	timeout := time.NewTimer(h.pollTimeout)
+	defer timeout.Stop()
+wait:
+	for {
+		evs, wake := h.since(resp.LastID)
+		if len(evs) > 0 {
+			resp.LastID = evs[len(evs)-1].ID
+		}
+		if visible := f.visible(evs); len(visible) > 0 {
+			resp.Events = visible
+			break
+		}
+		select {
+		case <-wake:
+		case <-timeout.C:
+			break wait
+		}
+	}
+	data, _ := json.Marshal(resp)
+	sendBody(b, req, "200 OK", "application/json", data, "Cache-Control: no-cache")
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventHubSince(t *testing.T) {
+	h := newEventHub()
+	h.keep = 2
+	_, wake := h.since(0)
+	for _, p := range []string{"/a", "/b", "/c"} {
+		h.publish(nil, "put", p)
+	}
+	select {
+	case <-wake:
+	default:
+		t.Error("Publish didn't wake waiters")
+	}
+
+	evs, _ := h.since(0)
+	if len(evs) != 2 || evs[0].ID != 2 || evs[1].Data != "/c" {
+		t.Errorf("Got %+v, want events 2 and 3", evs)
+	}
+	if evs, _ := h.since(3); len(evs) != 0 {
+		t.Errorf("Got %+v after the last id", evs)
+	}
+}
+
+func eventsServer(t *testing.T, auth ...authRule) (*server, string) {
+	t.Helper()
+	hub := newEventHub()
+	hub.heartbeat = 50 * time.Millisecond
+	hub.pollTimeout = 100 * time.Millisecond
+	s := &server{
+		def: &site{
+			root:      t.TempDir(),
+			mounts:    []mount{{prefix: "/up/", root: t.TempDir(), writable: true}},
+			maxUpload: 1 << 10,
+			events:    hub,
+			auth:      auth,
+		},
+		vhosts: []vhost{{"other.test", &site{
+			root:      t.TempDir(),
+			mounts:    []mount{{prefix: "/up/", root: t.TempDir(), writable: true}},
+			maxUpload: 1 << 10,
+			events:    hub,
+		}}},
+		events:     hub,
+		eventsPath: "/events",
+	}
+	return s, startServer(t, s)
+}
+
+// subscribe opens an event stream and returns a reader past the head.
+func subscribe(t *testing.T, addr, lastID string) *bufio.Reader {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	req := "GET /events HTTP/1.1\r\nHost: test\r\nAccept: text/event-stream\r\n"
+	if lastID != "" {
+		req += "Last-Event-ID: " + lastID + "\r\n"
+	}
+	c.Write([]byte(req + "\r\n"))
+
+	r := bufio.NewReader(c)
+	var head strings.Builder
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		head.WriteString(line)
+		if line == "\r\n" {
+			break
+		}
+	}
+	if got := headerValue(head.String(), "Content-Type"); got != "text/event-stream" {
+		t.Fatalf("Content-Type %q", got)
+	}
+	return r
+}
+
+// nextFrame reads up to the blank line ending a frame.
+func nextFrame(t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+	var frame strings.Builder
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == "\n" {
+			return frame.String()
+		}
+		frame.WriteString(line)
+	}
+}
+
+func put(t *testing.T, addr, path, body string) {
+	t.Helper()
+	putAs(t, addr, path, body, "Host: test\r\n")
+}
+
+// putAs PUTs with the header fields given, which must include Host.
+func putAs(t *testing.T, addr, path, body, fields string) {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("PUT " + path + " HTTP/1.1\r\n" + fields + "Content-Length: " +
+		strconv.Itoa(len(body)) + "\r\n\r\n" + body))
+	resp, _ := bufio.NewReader(c).ReadString('\n')
+	if !strings.HasPrefix(resp, "HTTP/1.1 201 ") && !strings.HasPrefix(resp, "HTTP/1.1 204 ") {
+		t.Fatalf("PUT got %q", resp)
+	}
+}
+
+func TestSSE(t *testing.T) {
+	_, addr := eventsServer(t)
+	r := subscribe(t, addr, "")
+	if got := nextFrame(t, r); got != "retry: 3000\n" {
+		t.Errorf("First frame %q, want the retry hint", got)
+	}
+	if got := nextFrame(t, r); got != ": heartbeat\n" {
+		t.Errorf("Idle stream sent %q, want a heartbeat", got)
+	}
+
+	put(t, addr, "/up/a.txt", "a")
+	put(t, addr, "/up/b.txt", "b")
+	for _, want := range []string{
+		"id: 1\nevent: put\ndata: /up/a.txt\n",
+		"id: 2\nevent: put\ndata: /up/b.txt\n",
+	} {
+		got := nextFrame(t, r)
+		for got == ": heartbeat\n" {
+			got = nextFrame(t, r)
+		}
+		if got != want {
+			t.Errorf("Got frame %q, want %q", got, want)
+		}
+	}
+
+	// A reconnecting client picks up after the last id it saw.
+	r = subscribe(t, addr, "1")
+	nextFrame(t, r) // retry
+	if got := nextFrame(t, r); got != "id: 2\nevent: put\ndata: /up/b.txt\n" {
+		t.Errorf("Resumed with %q, want event 2", got)
+	}
+}
+
+func TestLongPoll(t *testing.T) {
+	s, addr := eventsServer(t)
+
+	type pollResp struct {
+		Events []event `json:"events"`
+		LastID uint64  `json:"last_id"`
+	}
+	poll := func(after string) pollResp {
+		resp := get(t, addr, "/events?after="+after)
+		_, body, _ := strings.Cut(resp, "\r\n\r\n")
+		var p pollResp
+		if err := json.Unmarshal([]byte(body), &p); err != nil {
+			t.Fatalf("%v in %q", err, resp)
+		}
+		return p
+	}
+
+	if p := poll("0"); len(p.Events) != 0 || p.LastID != 0 {
+		t.Errorf("Timed out poll got %+v", p)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		s.events.publish(nil, "delete", "/up/x")
+	}()
+	p := poll("0")
+	if len(p.Events) != 1 || p.Events[0].Type != "delete" || p.LastID != 1 {
+		t.Errorf("Got %+v, want the delete", p)
+	}
+	s.events.publish(nil, "put", "/up/y")
+	if p := poll("1"); len(p.Events) != 1 || p.LastID != 2 {
+		t.Errorf("Got %+v, want only event 2", p)
+	}
+}
+
+func TestEventsAuth(t *testing.T) {
+	users, err := loadHtpasswd(testHtpasswd(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, addr := eventsServer(t, authRule{prefix: "/up/plans.txt", realm: "private", users: users})
+	alice := "Host: test\r\nAuthorization: Basic " + base64.StdEncoding.EncodeToString([]byte("alice:hunter2")) + "\r\n"
+	mallory := "Host: test\r\nAuthorization: Basic " + base64.StdEncoding.EncodeToString([]byte("alice:guess")) + "\r\n"
+
+	putAs(t, addr, "/up/plans.txt", "p", alice)
+	put(t, addr, "/up/public.txt", "q")
+	putAs(t, addr, "/up/elsewhere.txt", "e", "Host: other.test\r\n")
+
+	testcases := []struct {
+		name   string
+		fields string
+		want   string // paths seen, in order
+	}{
+		{"anonymous", "Host: test\r\n", "/up/public.txt"},
+		{"wrong password", mallory, "/up/public.txt"},
+		{"authorized", alice, "/up/plans.txt,/up/public.txt"},
+		{"other vhost", "Host: other.test\r\n", "/up/elsewhere.txt"},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := roundTrip(t, s, "GET /events?after=0 HTTP/1.1\r\n"+tc.fields+"\r\n")
+			_, body, _ := strings.Cut(resp, "\r\n\r\n")
+			var p struct {
+				Events []event `json:"events"`
+				LastID uint64  `json:"last_id"`
+			}
+			if err := json.Unmarshal([]byte(body), &p); err != nil {
+				t.Fatalf("%v in %q", err, resp)
+			}
+			var paths []string
+			for _, ev := range p.Events {
+				paths = append(paths, ev.Data)
+			}
+			if got := strings.Join(paths, ","); got != tc.want || p.LastID != 3 {
+				t.Errorf("Saw %q up to %d, want %q up to 3", got, p.LastID, tc.want)
+			}
+		})
+	}
+
+	// Only hidden events past ?after= is a timed out poll, not an
+	// answer right away.
+	putAs(t, addr, "/up/plans.txt", "m", alice)
+	start := time.Now()
+	resp := roundTrip(t, s, "GET /events?after=3 HTTP/1.1\r\nHost: test\r\n\r\n")
+	if elapsed := time.Since(start); elapsed < s.events.pollTimeout || !strings.Contains(resp, `"events":[],"last_id":4`) {
+		t.Errorf("Got %q after %v, want an empty answer past event 4 after the poll timeout", resp, elapsed)
+	}
+}
+
+func TestEventsBehindAuth(t *testing.T) {
+	users, err := loadHtpasswd(testHtpasswd(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := eventsServer(t, authRule{prefix: "/events", realm: "events", users: users})
+
+	resp := roundTrip(t, s, "GET /events?after=0 HTTP/1.1\r\nHost: test\r\n\r\n")
+	if got := firstLine(resp); got != "HTTP/1.1 401 Unauthorized" {
+		t.Errorf("Got %q, want 401 without credentials", got)
+	}
+	alice := "Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte("alice:hunter2")) + "\r\n"
+	resp = roundTrip(t, s, "GET /events?after=0 HTTP/1.1\r\nHost: test\r\n"+alice+"\r\n")
+	if got := firstLine(resp); got != "HTTP/1.1 200 OK" {
+		t.Errorf("Got %q, want 200 with credentials", got)
+	}
+}
+
+func TestWriteEventMultiline(t *testing.T) {
+	var b bytes.Buffer
+	writeEvent(&b, event{ID: 7, Type: "note", Data: "one\ntwo"})
+	if got, want := b.String(), "id: 7\nevent: note\ndata: one\ndata: two\n\n"; got != want {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+}
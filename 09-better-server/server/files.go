@@ -0,0 +1,39 @@
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// embedRoot is the -root value that serves the bundle compiled into
+// the binary.
+const embedRoot = "embed:"
+
+// bundle holds the files of bundle/ when built with -tags bundle, see
+// bundle.go.
+var bundle fs.FS
+
+// openFiles opens what a -root or -vhost value names for serving:
+// "embed:" is the bundle compiled into the binary and a .zip file is
+// served from inside the archive, which stays open until the config
+// naming it is retired. Anything else is a directory on disk, for which it returns
+// nil so that the policy can check symlinks against the real paths.
+func openFiles(root string) (fs.FS, error) {
+	if root == embedRoot {
+		if bundle == nil {
+			return nil, errors.New("no bundle was compiled in, build with -tags bundle")
+		}
+		return bundle, nil
+	}
+	if !strings.EqualFold(filepath.Ext(root), ".zip") {
+		return nil, nil
+	}
+	if info, err := os.Stat(root); err != nil || info.IsDir() {
+		return nil, err
+	}
+	return zip.OpenReader(root)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// docsBundle is the same small tree as a map and as a zip archive.
+var docsBundle = map[string]string{
+	"index.html":         "<h1>docs</h1>",
+	"guide/intro.html":   "<p>intro</p>",
+	"guide/style.css":    "p{}",
+	"guide/style.css.gz": "gzipped",
+	"guide/.draft.html":  "draft",
+	"data/list.json":     "[]",
+}
+
+func mapBundle() fstest.MapFS {
+	fsys := fstest.MapFS{}
+	for name, data := range docsBundle {
+		fsys[name] = &fstest.MapFile{Data: []byte(data), Mode: 0o644, ModTime: time.Unix(1e9, 0)}
+	}
+	return fsys
+}
+
+func zipBundle(t *testing.T) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "docs.zip")
+	f, err := os.Create(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	for name, data := range docsBundle {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(data))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestServeFromFS(t *testing.T) {
+	zipPath := zipBundle(t)
+	zipFiles, err := openFiles(zipPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backends := []struct {
+		name  string
+		root  string
+		files fs.FS
+	}{
+		{"map", "bundle", mapBundle()},
+		{"zip", zipPath, zipFiles},
+	}
+	testcases := []struct {
+		target string
+		header string
+		status string
+		ctype  string
+		body   string
+	}{
+		{"/", "", "200 OK", "text/html", "<h1>docs</h1>"},
+		{"/guide/intro.html", "", "200 OK", "text/html", "<p>intro</p>"},
+		{"/data/list.json", "", "200 OK", "application/json", "[]"},
+		{"/guide/style.css", "Accept-Encoding: gzip\r\n", "200 OK", "text/css", "gzipped"},
+		{"/guide", "", "301 Moved Permanently", "text/plain", "301 Moved Permanently"},
+		{"/guide/.draft.html", "", "404 File not found", "text/plain", "404 File not found"},
+		{"/missing", "", "404 File not found", "text/plain", "404 File not found"},
+	}
+	for _, be := range backends {
+		s := &server{def: &site{
+			root:   be.root,
+			files:  be.files,
+			policy: policy{strict: true},
+			cache:  newFileCache(1<<20, 1<<10),
+		}}
+		for _, tc := range testcases {
+			t.Run(be.name+tc.target, func(t *testing.T) {
+				resp := roundTrip(t, s, "GET "+tc.target+" HTTP/1.1\r\nHost: test\r\n"+tc.header+"\r\n")
+				if got := firstLine(resp); got != "HTTP/1.1 "+tc.status {
+					t.Errorf("Got %q, want %q", got, tc.status)
+				}
+				if got := headerValue(resp, "Content-Type"); got != tc.ctype {
+					t.Errorf("Content-Type %q, want %q", got, tc.ctype)
+				}
+				if _, body, _ := strings.Cut(resp, "\r\n\r\n"); body != tc.body {
+					t.Errorf("Body %q, want %q", body, tc.body)
+				}
+			})
+		}
+
+		t.Run(be.name+" listing", func(t *testing.T) {
+			resp := roundTrip(t, s, "GET /guide/ HTTP/1.1\r\nHost: test\r\nAccept: application/json\r\n\r\n")
+			_, body, _ := strings.Cut(resp, "\r\n\r\n")
+			var l listing
+			if err := json.Unmarshal([]byte(body), &l); err != nil {
+				t.Fatalf("%v in %q", err, resp)
+			}
+			var names []string
+			for _, e := range l.Entries {
+				names = append(names, e.Name)
+			}
+			if got := strings.Join(names, " "); got != "intro.html style.css style.css.gz" {
+				t.Errorf("Got entries %q", got)
+			}
+		})
+	}
+}
+
+func TestOpenFiles(t *testing.T) {
+	dir := t.TempDir()
+	if fsys, err := openFiles(dir); fsys != nil || err != nil {
+		t.Errorf("Directory: got %v, %v, want nil, nil", fsys, err)
+	}
+	if _, err := openFiles(filepath.Join(dir, "missing.zip")); err == nil {
+		t.Error("Missing archive opened")
+	}
+	if bundle == nil {
+		if _, err := openFiles(embedRoot); err == nil {
+			t.Error("embed: opened without a compiled in bundle")
+		}
+	}
+}
@@ -1,3 +1,5 @@
 module ukiran.com/better-server
 
 go 1.25.6
+
+require golang.org/x/crypto v0.48.0
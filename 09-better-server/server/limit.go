@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// limiter caps what one client, and all clients together, may ask of
+// the server. Requests are metered by a token bucket per client that
+// refills at rate tokens a second up to burst. Connections are capped
+// at perClient at a time for one client and total for everyone.
+//
+// A client is its IP address, except that addresses inside one of the
+// groups share a single bucket and connection count, e.g. a NATed
+// office behind 10.1.0.0/16. IPv6 clients are grouped by /64 since a
+// host usually owns the whole prefix.
+type limiter struct {
+	rate      float64 // tokens per second, 0 means no request limit
+	burst     float64
+	groups    []*net.IPNet
+	perClient int // 0 means no cap
+	total     int // 0 means no cap
+
+	now func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	conns   map[string]int
+	active  int
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter(rate float64, burst, perClient, total int, groups []*net.IPNet) *limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &limiter{
+		rate:      rate,
+		burst:     float64(burst),
+		groups:    groups,
+		perClient: perClient,
+		total:     total,
+		now:       time.Now,
+		buckets:   make(map[string]*bucket),
+		conns:     make(map[string]int),
+	}
+}
+
+// clientKey maps a remote address to the key its limits are kept
+// under.
+func (l *limiter) clientKey(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	for _, g := range l.groups {
+		if g.Contains(ip) {
+			return g.String()
+		}
+	}
+	if ip.To4() == nil {
+		return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+	}
+	return ip.String()
+}
+
+// admit takes a connection slot and a request token for the client.
+// When it says no, retry is how long the client should wait. The
+// caller must call release once the connection is done if admitted.
+func (l *limiter) admit(key string) (retry time.Duration, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.total > 0 && l.active >= l.total {
+		return time.Second, false
+	}
+	if l.perClient > 0 && l.conns[key] >= l.perClient {
+		return time.Second, false
+	}
+	if l.rate > 0 {
+		now := l.now()
+		b, ok := l.buckets[key]
+		if !ok {
+			b = &bucket{tokens: l.burst, last: now}
+			l.buckets[key] = b
+		}
+		b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+		b.last = now
+		if b.tokens < 1 {
+			wait := (1 - b.tokens) / l.rate
+			return time.Duration(wait * float64(time.Second)), false
+		}
+		b.tokens--
+	}
+
+	l.active++
+	l.conns[key]++
+	return 0, true
+}
+
+func (l *limiter) release(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	if l.conns[key]--; l.conns[key] <= 0 {
+		delete(l.conns, key)
+	}
+}
+
+// sweep forgets buckets that have refilled completely, as they are
+// no different from a fresh one.
+func (l *limiter) sweep() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// sendTooMany answers 429 without reading the request.
+func sendTooMany(c net.Conn, wait time.Duration) {
+	var b bytes.Buffer
+	buildTooMany(&b, wait)
+	if _, err := b.WriteTo(c); err != nil {
+		return
+	}
+	linger(c)
+}
+
+// linger gives a client that was answered before its request was read
+// a moment to finish sending, so that closing with its bytes unread
+// doesn't reset the connection before it sees the answer.
+func linger(c net.Conn) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		io.Copy(io.Discard, io.LimitReader(c, 64<<10))
+	}
+}
+
+// buildTooMany writes a 429 telling the client to wait.
+func buildTooMany(b *bytes.Buffer, wait time.Duration) {
+	status := "429 Too Many Requests"
+	buildResp(b, status, "text/plain", strconv.Itoa(len(status)),
+		"Retry-After: "+retryAfter(wait))
+	b.WriteString(status)
+}
+
+// retryAfter renders a wait as whole seconds, rounding up so the
+// client doesn't come back too early.
+func retryAfter(wait time.Duration) string {
+	return fmt.Sprint(int(math.Ceil(wait.Seconds())))
+}
+
+// parseCIDRs splits a comma separated flag value into networks.
+func parseCIDRs(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range strings.Split(s, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
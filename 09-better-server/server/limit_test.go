@@ -0,0 +1,222 @@
+package main
+
+import (
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := newLimiter(2, 3, 0, 0, nil) // 2/s, burst 3
+	l.now = func() time.Time { return now }
+
+	admit := func() (time.Duration, bool) {
+		wait, ok := l.admit("1.2.3.4")
+		if ok {
+			l.release("1.2.3.4")
+		}
+		return wait, ok
+	}
+	for i := range 3 {
+		if _, ok := admit(); !ok {
+			t.Fatalf("Request %d refused within burst", i)
+		}
+	}
+	wait, ok := admit()
+	if ok || wait != 500*time.Millisecond {
+		t.Fatalf("Got ok=%v wait=%v, want refused for 500ms", ok, wait)
+	}
+	if got := retryAfter(wait); got != "1" {
+		t.Errorf("Retry-After %q, want 1", got)
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if _, ok := admit(); !ok {
+		t.Error("Refused after refill")
+	}
+	if _, ok := admit(); ok {
+		t.Error("Admitted with an empty bucket")
+	}
+
+	// Other clients have their own bucket.
+	if _, ok := l.admit("5.6.7.8"); !ok {
+		t.Error("Fresh client refused")
+	}
+
+	now = now.Add(time.Hour)
+	l.sweep()
+	if len(l.buckets) != 0 {
+		t.Errorf("Sweep kept %d full buckets", len(l.buckets))
+	}
+}
+
+func TestClientKey(t *testing.T) {
+	groups, err := parseCIDRs("10.1.0.0/16, 192.168.0.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newLimiter(1, 1, 0, 0, groups)
+
+	testcases := []struct {
+		addr string
+		key  string
+	}{
+		{"1.2.3.4:5000", "1.2.3.4"},
+		{"10.1.200.7:5000", "10.1.0.0/16"},
+		{"10.2.0.1:5000", "10.2.0.1"},
+		{"192.168.0.99:80", "192.168.0.0/24"},
+		{"[2001:db8:1:2:aaaa::1]:443", "2001:db8:1:2::/64"},
+		{"[2001:db8:1:2:bbbb::9]:443", "2001:db8:1:2::/64"},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.addr, func(t *testing.T) {
+			addr, err := net.ResolveTCPAddr("tcp", tc.addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := l.clientKey(addr); got != tc.key {
+				t.Errorf("Got %q, want %q", got, tc.key)
+			}
+		})
+	}
+}
+
+// startServer serves s on a loopback port until the test ends.
+func startServer(t testing.TB, s *server) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go s.serve(ln)
+	return ln.Addr().String()
+}
+
+// get sends one request on a fresh connection and returns the response.
+func get(t testing.TB, addr, path string) string {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Error(err)
+		return ""
+	}
+	defer c.Close()
+	c.Write([]byte("GET " + path + " HTTP/1.1\r\nHost: test\r\n\r\n"))
+	c.(*net.TCPConn).CloseWrite()
+	resp, _ := io.ReadAll(c)
+	return string(resp)
+}
+
+func TestRateLimitManyClients(t *testing.T) {
+	testRateLimitManyClients(t, startServer)
+}
+
+// testRateLimitManyClients checks the rate limit of a server started
+// by start, one of the goroutine server and the event loop.
+func testRateLimitManyClients(t *testing.T, start func(testing.TB, *server) string) {
+	root := t.TempDir()
+	writeFile(t, root, "a.txt", "a")
+	s := &server{
+		def:    &site{root: root},
+		limits: newLimiter(0.01, 5, 0, 0, nil),
+	}
+	addr := start(t, s)
+
+	var mu sync.Mutex
+	counts := map[string]int{}
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Go(func() {
+			resp := get(t, addr, "/a.txt")
+			mu.Lock()
+			defer mu.Unlock()
+			counts[firstLine(resp)]++
+			if strings.Contains(resp, " 429 ") {
+				if ra := headerValue(resp, "Retry-After"); ra == "" || ra == "0" {
+					t.Errorf("429 with Retry-After %q", ra)
+				}
+			}
+		})
+	}
+	wg.Wait()
+
+	if counts["HTTP/1.1 200 OK"] != 5 || counts["HTTP/1.1 429 Too Many Requests"] != 15 {
+		t.Errorf("Got %v, want 5 OK and 15 refused", counts)
+	}
+}
+
+func TestConnectionCaps(t *testing.T) {
+	testConnectionCaps(t, startServer)
+}
+
+// testConnectionCaps checks the connection caps of a server started by
+// start.
+func testConnectionCaps(t *testing.T, start func(testing.TB, *server) string) {
+	root := t.TempDir()
+	writeFile(t, root, "a.txt", "a")
+
+	testcases := []struct {
+		name      string
+		perClient int
+		total     int
+	}{
+		{"per client", 2, 0},
+		{"global", 0, 2},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &server{
+				def:    &site{root: root},
+				limits: newLimiter(0, 0, tc.perClient, tc.total, nil),
+			}
+			addr := start(t, s)
+
+			// Two idle connections hold both slots while the server
+			// waits for their requests.
+			var idle []net.Conn
+			for range 2 {
+				c, err := net.Dial("tcp", addr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer c.Close()
+				idle = append(idle, c)
+			}
+			waitFor(t, func() bool {
+				s.limits.mu.Lock()
+				defer s.limits.mu.Unlock()
+				return s.limits.active == 2
+			})
+
+			if resp := get(t, addr, "/a.txt"); !strings.HasPrefix(resp, "HTTP/1.1 429 ") {
+				t.Errorf("Third connection got %q, want 429", firstLine(resp))
+			}
+
+			idle[0].Close()
+			waitFor(t, func() bool {
+				s.limits.mu.Lock()
+				defer s.limits.mu.Unlock()
+				return s.limits.active == 1
+			})
+			if resp := get(t, addr, "/a.txt"); !strings.HasPrefix(resp, "HTTP/1.1 200 ") {
+				t.Errorf("After a slot freed got %q, want 200", firstLine(resp))
+			}
+		})
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"io/fs"
+	"net/url"
+	"path"
+	"sort"
+	"time"
+)
+
+// dirEntry is one row of a generated directory listing.
+type dirEntry struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	IsDir   bool      `json:"is_dir"`
+}
+
+// Href is the entry's link relative to the listed directory.
+func (e dirEntry) Href() string {
+	href := url.PathEscape(e.Name)
+	if e.IsDir {
+		href += "/"
+	}
+	return href
+}
+
+type listing struct {
+	Path    string     `json:"path"`
+	Sort    string     `json:"sort"`
+	Order   string     `json:"order"`
+	Entries []dirEntry `json:"entries"`
+}
+
+// SortLink returns the query that sorts by column, flipping the order
+// when the listing is already sorted by it.
+func (l listing) SortLink(column string) string {
+	order := "asc"
+	if l.Sort == column && l.Order == "asc" {
+		order = "desc"
+	}
+	return "?sort=" + column + "&order=" + order
+}
+
+var listingTmpl = template.Must(template.New("listing").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Index of {{.Path}}</title></head>
+<body>
+<h1>Index of {{.Path}}</h1>
+<table>
+<tr>
+<th><a href="{{.SortLink "name"}}">Name</a></th>
+<th><a href="{{.SortLink "size"}}">Size</a></th>
+<th><a href="{{.SortLink "mtime"}}">Modified</a></th>
+</tr>
+{{- if ne .Path "/"}}
+<tr><td><a href="../">../</a></td><td></td><td></td></tr>
+{{- end}}
+{{- range .Entries}}
+<tr><td><a href="{{.Href}}">{{.Name}}{{if .IsDir}}/{{end}}</a></td><td>{{if not .IsDir}}{{.Size}}{{end}}</td><td>{{.ModTime.UTC.Format "2006-01-02 15:04:05"}}</td></tr>
+{{- end}}
+</table>
+</body>
+</html>
+`))
+
+// sendListing writes a listing of directory dir of m, as HTML by default or as JSON
+// when the Accept header prefers it. The query picks the sort column
+// (name, size, mtime) and order (asc, desc).
+func (s *site) sendListing(b *bytes.Buffer, req *request, m mount, urlPath, dir string) {
+	entries, err := s.readDirEntries(m, urlPath, dir)
+	if err != nil {
+		sendError(b, "500 Internal Server Error")
+		return
+	}
+
+	q, _ := url.ParseQuery(req.query)
+	l := listing{Path: req.path, Sort: q.Get("sort"), Order: q.Get("order")}
+	if l.Sort != "size" && l.Sort != "mtime" {
+		l.Sort = "name"
+	}
+	if l.Order != "desc" {
+		l.Order = "asc"
+	}
+	sortEntries(entries, l.Sort, l.Order == "desc")
+	l.Entries = entries
+
+	var body bytes.Buffer
+	ctype := preferredType(req.header["Accept"], "text/html", "application/json")
+	if ctype == "application/json" {
+		err = json.NewEncoder(&body).Encode(l)
+	} else {
+		ctype = "text/html; charset=utf-8"
+		err = listingTmpl.Execute(&body, l)
+	}
+	if err != nil {
+		sendError(b, "500 Internal Server Error")
+		return
+	}
+
+	sendBody(b, req, "200 OK", ctype, body.Bytes(), "Vary: Accept")
+}
+
+// readDirEntries lists directory dir of m, which urlPath names,
+// leaving out entries the policy would refuse to serve.
+func (s *site) readDirEntries(m mount, urlPath, dir string) ([]dirEntry, error) {
+	fsys := m.files()
+	des, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]dirEntry, 0, len(des))
+	for _, de := range des {
+		if s.policy.hidden(de.Name()) {
+			continue
+		}
+		if s.policy.strict && de.Type()&fs.ModeSymlink != 0 {
+			if _, err := s.policy.lookup(m, urlPath+de.Name()); err != nil {
+				continue
+			}
+		}
+		// Stat rather than de.Info so symlinks report their target
+		info, err := fs.Stat(fsys, path.Join(dir, de.Name()))
+		if err != nil {
+			continue // removed since ReadDir, or a dangling link
+		}
+		entries = append(entries, dirEntry{
+			Name:    de.Name(),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+			IsDir:   info.IsDir(),
+		})
+	}
+	return entries, nil
+}
+
+// sortEntries sorts by the given column, keeping the name as a tie
+// breaker so the output is stable.
+func sortEntries(entries []dirEntry, column string, desc bool) {
+	less := func(a, b dirEntry) bool {
+		switch column {
+		case "size":
+			if a.Size != b.Size {
+				return a.Size < b.Size
+			}
+		case "mtime":
+			if !a.ModTime.Equal(b.ModTime) {
+				return a.ModTime.Before(b.ModTime)
+			}
+		}
+		return a.Name < b.Name
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if desc {
+			return less(entries[j], entries[i])
+		}
+		return less(entries[i], entries[j])
+	})
+}
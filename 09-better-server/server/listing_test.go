@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSortEntries(t *testing.T) {
+	t1 := time.Unix(1e9, 0)
+	t2 := t1.Add(time.Hour)
+	entries := []dirEntry{
+		{Name: "c.txt", Size: 10, ModTime: t1},
+		{Name: "a.txt", Size: 30, ModTime: t2},
+		{Name: "b.txt", Size: 10, ModTime: t2},
+		{Name: "d", Size: 4096, ModTime: t1, IsDir: true},
+	}
+
+	testcases := []struct {
+		column string
+		desc   bool
+		want   string
+	}{
+		{"name", false, "a.txt,b.txt,c.txt,d"},
+		{"name", true, "d,c.txt,b.txt,a.txt"},
+		// Equal sizes and times fall back to the name.
+		{"size", false, "b.txt,c.txt,a.txt,d"},
+		{"size", true, "d,a.txt,c.txt,b.txt"},
+		{"mtime", false, "c.txt,d,a.txt,b.txt"},
+		{"mtime", true, "b.txt,a.txt,d,c.txt"},
+	}
+	for _, tc := range testcases {
+		name := tc.column
+		if tc.desc {
+			name += "/desc"
+		}
+		t.Run(name, func(t *testing.T) {
+			sorted := append([]dirEntry(nil), entries...)
+			sortEntries(sorted, tc.column, tc.desc)
+			var names []string
+			for _, e := range sorted {
+				names = append(names, e.Name)
+			}
+			if got := strings.Join(names, ","); got != tc.want {
+				t.Errorf("Got %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+// listingTree builds a root with a directory to list and one served
+// through its index.html:
+//
+//	root/
+//	  pub/a.txt       (3 bytes)
+//	  pub/big.txt     (10 bytes)
+//	  pub/sub dir/
+//	  site/index.html
+func listingTree(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	for _, dir := range []string{"pub/sub dir", "site"} {
+		if err := os.MkdirAll(filepath.Join(root, filepath.FromSlash(dir)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(t, root, "pub/a.txt", "abc")
+	writeFile(t, root, "pub/big.txt", "0123456789")
+	writeFile(t, root, "site/index.html", "<h1>site</h1>")
+	return root
+}
+
+func TestListing(t *testing.T) {
+	s := &server{def: &site{root: listingTree(t)}}
+
+	testcases := []struct {
+		name     string
+		target   string
+		accept   string
+		status   string
+		location string
+		ctype    string
+		vary     bool
+		body     []string // in this order
+	}{
+		{
+			name: "index.html", target: "/site/", status: "200 OK",
+			ctype: "text/html", body: []string{"<h1>site</h1>"},
+		},
+		{
+			name: "redirect to slash", target: "/site", status: "301 Moved Permanently",
+			location: "/site/",
+		},
+		{
+			name: "redirect keeps query", target: "/pub?sort=size&order=desc", status: "301 Moved Permanently",
+			location: "/pub/?sort=size&order=desc",
+		},
+		{
+			name: "html listing", target: "/pub/", status: "200 OK",
+			ctype: "text/html; charset=utf-8", vary: true,
+			body: []string{
+				"<title>Index of /pub/</title>",
+				`<a href="../">../</a>`,
+				`<a href="a.txt">a.txt</a></td><td>3</td>`,
+				`<a href="big.txt">big.txt</a></td><td>10</td>`,
+				`<a href="sub%20dir/">sub dir/</a></td><td></td>`,
+			},
+		},
+		{
+			name: "sort links flip", target: "/pub/?sort=name", status: "200 OK",
+			ctype: "text/html; charset=utf-8", vary: true,
+			body: []string{`href="?sort=name&amp;order=desc"`, `href="?sort=size&amp;order=asc"`},
+		},
+		{
+			name: "sorted by size descending", target: "/pub/?sort=size&order=desc", status: "200 OK",
+			ctype: "text/html; charset=utf-8", vary: true,
+			// Directory sizes vary by file system; only files are compared.
+			body: []string{"big.txt", "a.txt"},
+		},
+		{
+			name: "html preferred", target: "/pub/", accept: "application/json;q=0.5, text/html",
+			status: "200 OK", ctype: "text/html; charset=utf-8", vary: true,
+		},
+		{
+			name: "json listing", target: "/pub/?sort=mtime", accept: "application/json",
+			status: "200 OK", ctype: "application/json", vary: true,
+			body: []string{`"sort":"mtime"`, `"order":"asc"`, `"entries":[`},
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			raw := "GET " + tc.target + " HTTP/1.1\r\nHost: test\r\n"
+			if tc.accept != "" {
+				raw += "Accept: " + tc.accept + "\r\n"
+			}
+			resp := roundTrip(t, s, raw+"\r\n")
+			head, body, _ := strings.Cut(resp, "\r\n\r\n")
+
+			if got := firstLine(resp); got != "HTTP/1.1 "+tc.status {
+				t.Fatalf("Got %q, want status %s", got, tc.status)
+			}
+			if got := headerValue(head, "Location"); got != tc.location {
+				t.Errorf("Got Location %q, want %q", got, tc.location)
+			}
+			if tc.ctype != "" && headerValue(head, "Content-Type") != tc.ctype {
+				t.Errorf("Got Content-Type %q, want %q", headerValue(head, "Content-Type"), tc.ctype)
+			}
+			if got := headerValue(head, "Vary") == "Accept"; got != tc.vary {
+				t.Errorf("Got Vary %q, want Accept %v", headerValue(head, "Vary"), tc.vary)
+			}
+			rest := body
+			for _, want := range tc.body {
+				i := strings.Index(rest, want)
+				if i < 0 {
+					t.Fatalf("Body %q lacks %q, or not in order", body, want)
+				}
+				rest = rest[i+len(want):]
+			}
+		})
+	}
+}
+
+func TestListingJSON(t *testing.T) {
+	s := &server{def: &site{root: listingTree(t)}}
+	resp := roundTrip(t, s, "GET /pub/?sort=name&order=desc HTTP/1.1\r\nHost: test\r\nAccept: application/json\r\n\r\n")
+	_, body, _ := strings.Cut(resp, "\r\n\r\n")
+
+	var l listing
+	if err := json.Unmarshal([]byte(body), &l); err != nil {
+		t.Fatalf("Decoding %q: %v", body, err)
+	}
+	if l.Path != "/pub/" || l.Sort != "name" || l.Order != "desc" || len(l.Entries) != 3 {
+		t.Fatalf("Got %+v", l)
+	}
+	sub, big, a := l.Entries[0], l.Entries[1], l.Entries[2]
+	if sub.Name != "sub dir" || !sub.IsDir || big.Name != "big.txt" || big.Size != 10 || a.Name != "a.txt" || a.Size != 3 || a.IsDir {
+		t.Errorf("Got entries %+v", l.Entries)
+	}
+}
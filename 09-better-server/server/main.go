@@ -1,82 +1,359 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
+	"mime"
 	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 const SERVE_FILES = "./testdata"
 
+// server carries the settings every connection handler needs.
+type server struct {
+	def    *site    // serves requests no vhost claims
+	vhosts []vhost  // name based virtual hosts
+	limits *limiter // nil when clients are not limited
+
+	metrics     *metrics // nil when metrics are off
+	metricsPath string
+
+	errorPages errorPages // by status code
+
+	events     *eventHub // nil when the events endpoint is off
+	eventsPath string
+
+	wsPrefix string  // WebSocket demos live below it, off when empty
+	room     *wsRoom // clients of the broadcast demo
+
+	live    *atomic.Pointer[server] // the latest config, nil without -config
+	conns   *connCount              // connections handed to this config
+	closers []io.Closer             // archives it opened, see retire
+}
+
+// site is one document tree and the rules for serving it.
+type site struct {
+	root   string
+	files  fs.FS // when set, root is served from it, see openFiles
+	policy policy
+	cache  *fileCache // nil when caching is off
+	auth   []authRule
+	mounts []mount
+
+	maxUpload  int64         // largest PUT body accepted, in bytes
+	cgiTimeout time.Duration // CGI scripts are killed after this long
+
+	events *eventHub // told about uploads and deletes, may be nil
+}
+
 func main() {
+	var flags config
 	port := flag.String("port", "28333", "port to listen request")
+	configFile := flag.String("config", "", "read sites, mounts, auth, limits and error pages from this JSON `file` over the flags; SIGHUP reloads it")
+	check := flag.Bool("check-config", false, "check the -config file and the flags, then exit")
+	flag.StringVar(&flags.Root, "root", SERVE_FILES, "directory or .zip archive to serve files from, or embed: for the compiled in bundle")
+	flag.BoolVar(&flags.Strict, "strict", false,
+		"resolve symlinks, refuse files outside root and hide dotfiles")
+	flag.StringVar(&flags.Hide, "hide", "", "comma separated name patterns never to serve, e.g. '*.bak,secret*'")
+	cacheSize := flag.Int64("cache-size", 0, "bytes of file data to keep in memory, 0 disables the cache")
+	cacheMaxFile := flag.Int64("cache-max-file", 64<<10, "largest file in bytes the cache will hold")
+	flag.Int64Var(&flags.MaxUpload, "max-upload", 100<<20, "largest PUT body in bytes")
+	flag.DurationVar((*time.Duration)(&flags.CGITimeout), "cgi-timeout", 30*time.Second, "kill CGI scripts running longer than this")
+	flag.Var((*listFlag)(&flags.Mounts), "mount", "serve `/prefix=dir[,rw|cgi]` from its own directory; rw allows PUT and DELETE, cgi runs scripts (repeatable)")
+	flag.Var((*listFlag)(&flags.Proxies), "proxy", "forward `/prefix=host:port[,host:port]` to upstreams, round-robin (repeatable)")
+	flag.DurationVar((*time.Duration)(&flags.ProxyTimeout), "proxy-timeout", 30*time.Second, "upstream connect and response header timeout")
+	flag.Float64Var(&flags.Rate, "rate", 0, "requests per second allowed per client, 0 for no limit")
+	flag.IntVar(&flags.Burst, "burst", 10, "requests a client may make at once before -rate applies")
+	flag.StringVar(&flags.RateCIDR, "rate-cidr", "", "comma separated networks whose clients share one limit, e.g. 10.1.0.0/16")
+	flag.IntVar(&flags.MaxConnsPerIP, "max-conns-per-ip", 0, "concurrent connections per client, 0 for no cap")
+	flag.IntVar(&flags.MaxConns, "max-conns", 0, "concurrent connections in total, 0 for no cap")
+	flag.Var((*listFlag)(&flags.Auth), "auth", "require Basic auth under `/prefix=htpasswd[=realm]` (repeatable)")
+	flag.Var((*listFlag)(&flags.ErrorPages), "error-page", "answer a status with `code=file`, a static page or an html/template if it ends in .tmpl (repeatable)")
+	eventsPath := flag.String("events", "", "stream upload and delete events at this `path`, as SSE or by long-polling; off when empty")
+	wsPrefix := flag.String("ws", "", "serve the WebSocket echo and broadcast demos under this `prefix`, e.g. /ws; off when empty")
+	useEpoll := flag.Bool("epoll", false, "serve files from a single-threaded epoll loop instead of a goroutine per connection (Linux only)")
+	metricsPath := flag.String("metrics", "", "serve Prometheus metrics at this `path`, e.g. /metrics; off when empty")
+	flag.Var((*listFlag)(&flags.Vhosts), "vhost", "serve Host `name=dir` from its own root, e.g. docs.internal=./docs or *.example.com=./ex (repeatable)")
 	flag.Parse()
 
+	var cache *fileCache
+	if *cacheSize > 0 {
+		cache = newFileCache(*cacheSize, *cacheMaxFile)
+	}
+	base := &server{}
+	if *eventsPath != "" {
+		base.events, base.eventsPath = newEventHub(), cleanPath(*eventsPath)
+	}
+	if *wsPrefix != "" {
+		base.wsPrefix, base.room = strings.TrimSuffix(cleanPath(*wsPrefix), "/")+"/", newWSRoom()
+	}
+	if *metricsPath != "" {
+		base.metrics, base.metricsPath = newMetrics(), cleanPath(*metricsPath)
+	}
+
+	var s *server
+	var err error
+	switch {
+	case *check:
+		if *configFile == "" {
+			log.Fatal("-check-config needs -config")
+		}
+		cfg, err := loadConfig(*configFile, flags)
+		if err == nil {
+			_, err = cfg.build(base, cache)
+		}
+		if err != nil {
+			log.Fatalf("Bad config: %v", err)
+		}
+		fmt.Printf("%s: OK\n", *configFile)
+		return
+	case *configFile != "":
+		var r *reloader
+		r, s, err = newReloader(*configFile, flags, base, cache)
+		if err != nil {
+			log.Fatalf("Bad config: %v", err)
+		}
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				r.reload()
+			}
+		}()
+	default:
+		s, err = flags.build(base, cache)
+		if err != nil {
+			log.Fatalf("Bad flags: %v", err)
+		}
+	}
+	if cache != nil {
+		go logCacheStats(cache, time.Minute)
+	}
+	go s.sweepLimits(time.Minute)
+
 	addr := ":" + *port
 	listener, err := net.Listen("tcp", addr)
 	if err != nil {
 		log.Fatalf("Error listening: %v", err)
 	}
 	log.Printf("Server listening at port %s", addr)
+	if *useEpoll {
+		loop, err := s.newEventLoop(listener)
+		if err != nil {
+			log.Fatalf("Error starting event loop: %v", err)
+		}
+		if err := loop.run(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	s.serve(listener)
+}
 
+// serve accepts connections until the listener is closed.
+func (s *server) serve(listener net.Listener) {
 	for {
 		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			log.Print(err)
+			if s.metrics != nil {
+				s.metrics.acceptErrors.Add(1)
+			}
 			continue
 		}
-		go handleConn(conn)
+		cur := s.acquire()
+		go func() {
+			defer cur.conns.release()
+			cur.handleConn(conn)
+		}()
 	}
 }
 
-func handleConn(c net.Conn) {
+func (s *server) handleConn(c net.Conn) {
+	if s.metrics != nil {
+		mc := s.metrics.track(c)
+		defer mc.done()
+		c = mc
+	}
 	defer c.Close()
 
-	var resp bytes.Buffer
-	defer resp.WriteTo(c)
+	if s.limits != nil {
+		key := s.limits.clientKey(c.RemoteAddr())
+		wait, ok := s.limits.admit(key)
+		if !ok {
+			sendTooMany(c, wait)
+			return
+		}
+		defer s.limits.release(key)
+	}
+
+	var (
+		resp bytes.Buffer
+		req  *request
+		err  error
+	)
+	defer func() {
+		s.errorPages.render(&resp, req)
+		if _, werr := resp.WriteTo(c); werr == nil && errors.Is(err, errHeadTooLarge) {
+			linger(c) // the rest of the head is still coming
+		}
+	}()
 
-	method, file := parseReq(c)
-	if method == "" || file == "" {
+	req, err = parseReq(c)
+	if errors.Is(err, errHeadTooLarge) {
+		sendError(&resp, "431 Request Header Fields Too Large")
+		return
+	}
+	if err != nil {
+		sendError(&resp, "400 Bad Request")
+		return
+	}
+	if s.metrics != nil && req.method == "GET" && req.path == s.metricsPath {
+		s.sendMetrics(&resp)
+		return
+	}
+	site := s.siteFor(req)
+	if site == nil {
 		sendError(&resp, "400 Bad Request")
 		return
 	}
+	if !site.authorized(&resp, req) {
+		return
+	}
+	if s.wsPrefix != "" && req.method == "GET" && strings.HasPrefix(req.path, s.wsPrefix) {
+		s.serveWebSocket(c, &resp, req)
+		return
+	}
+	if s.events != nil && req.method == "GET" && req.path == s.eventsPath {
+		s.serveEvents(c, &resp, req, site)
+		return
+	}
+	site.dispatch(c, &resp, req)
+}
 
-	safePath := filepath.Join(SERVE_FILES, filepath.Clean("/"+file))
+// dispatch answers a request the auth rules let through: a proxy or
+// CGI mount covering its path handles it, the files on s otherwise.
+func (s *site) dispatch(c net.Conn, b *bytes.Buffer, req *request) {
+	switch m, urlPath := s.locate(req.path); {
+	case m.proxy != nil:
+		s.serveProxy(c, b, req, m)
+		return
+	case m.cgi:
+		s.serveCGI(c, b, req, m, urlPath)
+		return
+	}
 
-	// DEBUG:
-	absPath, _ := filepath.Abs(safePath)
-	fmt.Printf("Attempting to serve: %s\n", absPath)
+	switch req.method {
+	case "GET":
+		s.servePath(b, req)
+	case "PUT":
+		s.handlePut(b, req)
+	case "DELETE":
+		s.handleDelete(b, req)
+	default:
+		sendError(b, "405 Method Not Allowed")
+	}
+}
 
-	if method == "GET" {
-		data, err := os.ReadFile(safePath)
-		if err != nil {
-			if os.IsNotExist(err) {
-				sendError(&resp, "404 File not found")
-				return
-			} else {
-				sendError(&resp, "500 Internal Server Error")
+// servePath answers with the file req.path names. Directories are
+// served through their index.html when they have one and as a
+// generated listing otherwise.
+func (s *site) servePath(b *bytes.Buffer, req *request) {
+	m, urlPath := s.locate(req.path)
+	name, err := s.policy.lookup(m, urlPath)
+	if err != nil {
+		sendFileError(b, err)
+		return
+	}
+
+	fsys := m.files()
+	info, err := fs.Stat(fsys, name)
+	if err != nil {
+		sendFileError(b, err)
+		return
+	}
+
+	if info.IsDir() {
+		// Without the trailing slash relative links in the page
+		// would resolve against the parent directory.
+		if !strings.HasSuffix(req.path, "/") {
+			sendRedirect(b, escapePath(req.path)+"/", req.query)
+			return
+		}
+		index, err := s.policy.lookup(m, urlPath+"index.html")
+		if err == nil {
+			var fi fs.FileInfo
+			fi, err = fs.Stat(fsys, index)
+			if err == nil && !fi.Mode().IsRegular() {
+				err = fs.ErrNotExist
 			}
+		}
+		if err != nil {
+			s.sendListing(b, req, m, urlPath, name)
 			return
 		}
+		name, urlPath = index, urlPath+"index.html"
+	}
 
-		var ftype string = "text/plain"
-		switch filepath.Ext(safePath) {
-		case ".html":
-			ftype = "text/html"
-		case ".jpg", ".jpeg":
-			ftype = "image/jpeg"
+	s.sendFile(b, req, m, urlPath, name)
+}
+
+// contentType picks the media type from the file extension. Types the
+// switch doesn't know come from the mime package, and anything it
+// doesn't know either is sent as opaque bytes, which is neither
+// compressed on the fly nor shown as text.
+func contentType(fpath string) string {
+	var ftype string = "application/octet-stream"
+	switch ext := filepath.Ext(fpath); ext {
+	case ".txt":
+		ftype = "text/plain"
+	case ".html":
+		ftype = "text/html"
+	case ".css":
+		ftype = "text/css"
+	case ".js":
+		ftype = "application/javascript"
+	case ".json":
+		ftype = "application/json"
+	case ".svg":
+		ftype = "image/svg+xml"
+	case ".jpg", ".jpeg":
+		ftype = "image/jpeg"
+	default:
+		if t := mime.TypeByExtension(ext); t != "" {
+			ftype = t
 		}
+	}
+	return ftype
+}
 
-		buildResp(&resp, "200 OK", ftype, strconv.Itoa(len(data)))
-		resp.Write(data)
+// sendFileError maps a file system error to a response.
+func sendFileError(b *bytes.Buffer, err error) {
+	switch {
+	case os.IsNotExist(err):
+		sendError(b, "404 File not found")
+	case os.IsPermission(err):
+		sendError(b, "403 Forbidden")
+	case errors.Is(err, errConflict):
+		sendError(b, "409 Conflict")
+	default:
+		sendError(b, "500 Internal Server Error")
 	}
 }
 
@@ -85,37 +362,31 @@ func sendError(b *bytes.Buffer, status string) {
 	b.WriteString(status)
 }
 
-func buildResp(b *bytes.Buffer, status, ctype, clen string) {
+func sendRedirect(b *bytes.Buffer, location, query string) {
+	if query != "" {
+		location += "?" + query
+	}
+	status := "301 Moved Permanently"
+	buildResp(b, status, "text/plain", strconv.Itoa(len(status)),
+		"Location: "+location)
+	b.WriteString(status)
+}
+
+// buildResp writes the status line and headers. An empty clen leaves
+// out Content-Length, as a 204 must. extra holds additional
+// "Name: value" fields.
+func buildResp(b *bytes.Buffer, status, ctype, clen string, extra ...string) {
 	// HTTP standards require \r\n (CRLF)
 	heads := fmt.Sprintf(
 		"HTTP/1.1 %s\r\n"+
-			"Content-Type: %s\r\n"+
-			"Content-Length: %s\r\n"+
-			"Connection: close\r\n\r\n",
-		status, ctype, clen)
+			"Content-Type: %s\r\n",
+		status, ctype)
 	b.Write([]byte(heads))
-}
-
-// parseReq returns Method (GET) and FilePath (/file1.txt) from the
-// request, nothing else.
-func parseReq(in io.Reader) (method, file string) {
-	scanner := bufio.NewScanner(in)
-	if !scanner.Scan() {
-		return "", "" //  empty input
+	if clen != "" {
+		b.WriteString("Content-Length: " + clen + "\r\n")
 	}
-
-	// example: GET /file2.html HTTP/1.1
-	header := scanner.Text()
-	parts := strings.Fields(header)
-	if len(parts) < 2 {
-		return "", ""
+	for _, h := range extra {
+		b.WriteString(h + "\r\n")
 	}
-
-	method = parts[0]
-	file = stripPrefixSlash(parts[1])
-	return method, file
-}
-
-func stripPrefixSlash(s string) string {
-	return strings.TrimPrefix(s, "/")
+	b.WriteString("Connection: close\r\n\r\n")
 }
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	testMetrics(t, startServer)
+}
+
+// testMetrics checks the metrics of a server started by start.
+func testMetrics(t *testing.T, start func(testing.TB, *server) string) {
+	root := t.TempDir()
+	writeFile(t, root, "a.txt", "hello")
+	s := &server{def: &site{root: root}, metrics: newMetrics(), metricsPath: "/metrics"}
+	addr := start(t, s)
+
+	get(t, addr, "/a.txt")
+	get(t, addr, "/a.txt")
+	get(t, addr, "/missing")
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Write([]byte("BREW /pot HTTP/1.1\r\nHost: test\r\n\r\n"))
+	c.(*net.TCPConn).CloseWrite()
+	io.ReadAll(c)
+	c.Close()
+
+	// Connections are recorded once closed, which may trail the
+	// client seeing the end of the response.
+	var resp string
+	waitFor(t, func() bool {
+		resp = get(t, addr, "/metrics")
+		return strings.Contains(resp, "http_request_duration_seconds_count 4\n")
+	})
+
+	if got := headerValue(resp, "Content-Type"); !strings.HasPrefix(got, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type %q", got)
+	}
+	for _, want := range []string{
+		`http_requests_total{method="GET",code="200"} 2`,
+		`http_requests_total{method="GET",code="404"} 1`,
+		`http_requests_total{method="OTHER",code="405"} 1`,
+		`http_request_duration_seconds_bucket{le="+Inf"} 4`,
+		"http_active_connections 1",
+		"http_accept_errors_total 0",
+		"# TYPE http_sent_bytes_total counter",
+	} {
+		if !strings.Contains(resp, want+"\n") {
+			t.Errorf("Missing %q in\n%s", want, resp)
+		}
+	}
+	if strings.Contains(resp, "http_received_bytes_total 0\n") {
+		t.Error("No bytes counted in")
+	}
+}
+
+func TestMetricsOff(t *testing.T) {
+	root := t.TempDir()
+	s := &server{def: &site{root: root}}
+	if resp := get(t, startServer(t, s), "/metrics"); !strings.HasPrefix(resp, "HTTP/1.1 404 ") {
+		t.Errorf("Got %q, want 404", firstLine(resp))
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// mount serves the URL paths under prefix from its own directory.
+// Only writable mounts accept PUT and DELETE. A CGI mount runs the
+// executables in its directory instead of sending them, and a proxy
+// mount has no directory but forwards requests to its upstreams.
+//
+// When fsys is set files are read from it rather than from the
+// directory, and root only names it, e.g. the path of a zip archive.
+type mount struct {
+	prefix   string
+	root     string
+	fsys     fs.FS
+	writable bool
+	cgi      bool
+	proxy    *upstreamPool
+}
+
+// files returns the file system GET requests are served from.
+func (m mount) files() fs.FS {
+	if m.fsys != nil {
+		return m.fsys
+	}
+	return os.DirFS(m.root)
+}
+
+// path names a file of the mount's file system uniquely across all
+// mounts and sites, for logs and the file cache.
+func (m mount) path(name string) string {
+	return filepath.Join(m.root, filepath.FromSlash(name))
+}
+
+// locate returns the mount covering urlPath, the longest prefix
+// winning, and the path below it. Paths no mount covers fall back to
+// the site root, which is read-only.
+func (s *site) locate(urlPath string) (mount, string) {
+	best := mount{prefix: "/", root: s.root, fsys: s.files}
+	for _, m := range s.mounts {
+		if pathHasPrefix(urlPath, m.prefix) && len(m.prefix) >= len(best.prefix) {
+			best = m
+		}
+	}
+	rel := strings.TrimPrefix(urlPath, strings.TrimSuffix(best.prefix, "/"))
+	if !strings.HasPrefix(rel, "/") {
+		rel = "/" + rel
+	}
+	return best, rel
+}
+
+// mountFlag collects repeated -mount /prefix=dir[,rw|cgi] flags.
+type mountFlag []mount
+
+func (f *mountFlag) String() string {
+	var parts []string
+	for _, m := range *f {
+		parts = append(parts, m.prefix+"="+m.root)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f *mountFlag) Set(v string) error {
+	prefix, rest, ok := strings.Cut(v, "=")
+	dir, opt, _ := strings.Cut(rest, ",")
+	if !ok || !strings.HasPrefix(prefix, "/") || dir == "" {
+		return fmt.Errorf("want /prefix=dir[,rw|cgi], got %q", v)
+	}
+	switch opt {
+	case "", "ro", "rw", "cgi":
+	default:
+		return fmt.Errorf("unknown mount option %q", opt)
+	}
+	*f = append(*f, mount{
+		prefix:   cleanPath(prefix),
+		root:     dir,
+		writable: opt == "rw",
+		cgi:      opt == "cgi",
+	})
+	return nil
+}
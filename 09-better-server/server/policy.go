@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// policy decides which files under a document root may be served.
+//
+// In strict mode symlinks are resolved and anything whose real path
+// lies outside the root is refused, and dotfiles are hidden. Names
+// matching one of the hide patterns (path.Match syntax, checked
+// against every path element) are hidden in either mode.
+type policy struct {
+	strict bool
+	hide   []string
+}
+
+// resolve maps a cleaned URL path to a file under root. Hidden files
+// report fs.ErrNotExist so their existence is not leaked; symlink
+// escapes report fs.ErrPermission.
+func (p policy) resolve(root, urlPath string) (string, error) {
+	if p.hiddenPath(urlPath) {
+		return "", fs.ErrNotExist
+	}
+	fpath := filepath.Join(root, filepath.FromSlash(path.Clean("/"+urlPath)))
+	if !p.strict {
+		return fpath, nil
+	}
+
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	real, err := filepath.EvalSymlinks(fpath)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(realRoot, real)
+	if err != nil || !filepath.IsLocal(rel) {
+		return "", fs.ErrPermission
+	}
+	// A link inside the root may still point at something hidden,
+	// e.g. public -> .git
+	if p.hiddenPath(filepath.ToSlash(rel)) {
+		return "", fs.ErrNotExist
+	}
+	return fpath, nil
+}
+
+// lookup maps a cleaned URL path below m to a name in m.files(),
+// applying the same rules as resolve. Only directories on disk can
+// hold symlinks, archives and embedded bundles need no strict check.
+func (p policy) lookup(m mount, urlPath string) (string, error) {
+	if m.fsys != nil {
+		if p.hiddenPath(urlPath) {
+			return "", fs.ErrNotExist
+		}
+	} else if _, err := p.resolve(m.root, urlPath); err != nil {
+		return "", err
+	}
+	name := strings.Trim(path.Clean("/"+urlPath), "/")
+	if name == "" {
+		name = "."
+	}
+	return name, nil
+}
+
+// hiddenPath reports whether any element of the slash separated path
+// is hidden.
+func (p policy) hiddenPath(urlPath string) bool {
+	for _, name := range strings.Split(urlPath, "/") {
+		if name != "" && p.hidden(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// hidden reports whether a single file name is hidden.
+func (p policy) hidden(name string) bool {
+	if name == "." || name == ".." {
+		return false
+	}
+	if p.strict && strings.HasPrefix(name, ".") {
+		return true
+	}
+	for _, pattern := range p.hide {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePatterns splits a comma separated flag value into hide
+// patterns, rejecting malformed ones up front.
+func parsePatterns(s string) ([]string, error) {
+	var patterns []string
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// hostileTree builds a document root full of ways out of it, next to
+// an "outside" directory holding a secret:
+//
+//	root/
+//	  file1.txt
+//	  .env
+//	  notes.bak
+//	  .git/config
+//	  docs/index.html
+//	  inside      -> file1.txt
+//	  escape      -> outside/secret.txt (absolute)
+//	  relescape   -> ../outside/secret.txt
+//	  escapedir   -> outside/
+//	  docs/up     -> ../../outside
+//	  public      -> .git
+//	  dangling    -> nowhere
+func hostileTree(t *testing.T) string {
+	t.Helper()
+	base := t.TempDir()
+	root := filepath.Join(base, "root")
+	outside := filepath.Join(base, "outside")
+
+	files := map[string]string{
+		"root/file1.txt":       "hello",
+		"root/.env":            "TOKEN=1",
+		"root/notes.bak":       "old",
+		"root/.git/config":     "[core]",
+		"root/docs/index.html": "<p>docs</p>",
+		"outside/secret.txt":   "secret",
+	}
+	for name, data := range files {
+		p := filepath.Join(base, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	links := map[string]string{
+		"root/inside":    "file1.txt",
+		"root/escape":    filepath.Join(outside, "secret.txt"),
+		"root/relescape": "../outside/secret.txt",
+		"root/escapedir": outside,
+		"root/docs/up":   "../../outside",
+		"root/public":    ".git",
+		"root/dangling":  "nowhere",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(base, filepath.FromSlash(name))); err != nil {
+			t.Skipf("symlinks unsupported: %v", err)
+		}
+	}
+	return root
+}
+
+func TestPolicyResolve(t *testing.T) {
+	root := hostileTree(t)
+	strict := policy{strict: true, hide: []string{"*.bak"}}
+	open := policy{}
+
+	testcases := []struct {
+		pol     policy
+		path    string
+		wantErr error
+	}{
+		{strict, "/file1.txt", nil},
+		{strict, "/inside", nil},
+		{strict, "/docs/", nil},
+		{strict, "/", nil},
+		{strict, "/escape", fs.ErrPermission},
+		{strict, "/relescape", fs.ErrPermission},
+		{strict, "/escapedir/secret.txt", fs.ErrPermission},
+		{strict, "/docs/up/secret.txt", fs.ErrPermission},
+		{strict, "/.env", fs.ErrNotExist},
+		{strict, "/.git/config", fs.ErrNotExist},
+		{strict, "/public/config", fs.ErrNotExist},
+		{strict, "/notes.bak", fs.ErrNotExist},
+		{strict, "/dangling", fs.ErrNotExist},
+		{strict, "/missing.txt", fs.ErrNotExist},
+
+		// The open policy only applies the hide patterns.
+		{open, "/escape", nil},
+		{open, "/.env", nil},
+		{policy{hide: []string{"*.bak"}}, "/notes.bak", fs.ErrNotExist},
+	}
+	for _, tc := range testcases {
+		name := tc.path
+		if !tc.pol.strict {
+			name = "open" + name
+		}
+		t.Run(name, func(t *testing.T) {
+			_, err := tc.pol.resolve(root, tc.path)
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("Got %v, want %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestListingHidesRefusedEntries(t *testing.T) {
+	root := hostileTree(t)
+	s := &site{root: root, policy: policy{strict: true, hide: []string{"*.bak"}}}
+
+	entries, err := s.readDirEntries(mount{root: root}, "/", ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name)
+	}
+	got := strings.Join(names, ",")
+	// os.ReadDir returns entries sorted by name
+	want := "docs,file1.txt,inside"
+	if got != want {
+		t.Errorf("Got %s, want %s", got, want)
+	}
+}
+
+func TestStrictServe(t *testing.T) {
+	root := hostileTree(t)
+	s := &server{def: &site{root: root, policy: policy{strict: true}}}
+
+	testcases := []struct {
+		path   string
+		status string
+	}{
+		{"/file1.txt", "200 OK"},
+		{"/inside", "200 OK"},
+		{"/escape", "403 Forbidden"},
+		{"/%2e%2e/outside/secret.txt", "404 File not found"},
+		{"/.env", "404 File not found"},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.path, func(t *testing.T) {
+			resp := roundTrip(t, s, "GET "+tc.path+" HTTP/1.1\r\nHost: test\r\n\r\n")
+			if !strings.HasPrefix(resp, "HTTP/1.1 "+tc.status+"\r\n") {
+				t.Errorf("Got %q, want status %s", firstLine(resp), tc.status)
+			}
+			if strings.Contains(resp, "secret") {
+				t.Errorf("Secret leaked: %q", resp)
+			}
+		})
+	}
+}
+
+// roundTrip runs one request through s.handleConn over loopback TCP
+// and returns the raw response. The client half-closes after writing,
+// like the 05 client does.
+func roundTrip(t *testing.T, s *server, raw string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err == nil {
+			s.handleConn(c)
+		}
+	}()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte(raw))
+	c.(*net.TCPConn).CloseWrite()
+
+	resp, _ := io.ReadAll(c)
+	return string(resp)
+}
+
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\r\n")
+	return line
+}
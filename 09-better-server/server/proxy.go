@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net"
+	"net/textproto"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// upstreamPool hands out backends round-robin. Health is checked
+// passively: a backend that fails maxFails times in a row, by refusing
+// the connection or not answering in time, is skipped for cooldown.
+type upstreamPool struct {
+	upstreams []*upstream
+	next      atomic.Uint32
+	timeout   time.Duration // dial and response header deadline
+
+	maxFails int
+	cooldown time.Duration
+}
+
+type upstream struct {
+	addr string // host:port
+
+	mu        sync.Mutex
+	fails     int
+	downUntil time.Time
+}
+
+func newUpstreamPool(addrs []string, timeout time.Duration) *upstreamPool {
+	p := &upstreamPool{timeout: timeout, maxFails: 2, cooldown: 10 * time.Second}
+	for _, addr := range addrs {
+		p.upstreams = append(p.upstreams, &upstream{addr: addr})
+	}
+	return p
+}
+
+// pick returns the upstreams to try for one request: every healthy
+// one, starting from the next in turn. When all are down they are all
+// returned anyway, as failing fast helps no one.
+func (p *upstreamPool) pick() []*upstream {
+	start := int(p.next.Add(1)-1) % len(p.upstreams)
+	now := time.Now()
+	var healthy, down []*upstream
+	for i := range p.upstreams {
+		u := p.upstreams[(start+i)%len(p.upstreams)]
+		if u.healthy(now) {
+			healthy = append(healthy, u)
+		} else {
+			down = append(down, u)
+		}
+	}
+	if len(healthy) == 0 {
+		return down
+	}
+	return healthy
+}
+
+func (u *upstream) healthy(now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return !now.Before(u.downUntil)
+}
+
+func (p *upstreamPool) markFailed(u *upstream) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.fails++
+	if u.fails >= p.maxFails {
+		u.downUntil = time.Now().Add(p.cooldown)
+		log.Printf("Upstream %s marked down for %v", u.addr, p.cooldown)
+	}
+}
+
+func (p *upstreamPool) markOK(u *upstream) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.fails = 0
+	u.downUntil = time.Time{}
+}
+
+// Hop-by-hop fields describe one connection, so a proxy must not pass
+// them on (RFC 9110, 7.6.1).
+var hopByHop = map[string]bool{
+	"Connection":          true,
+	"Keep-Alive":          true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Proxy-Connection":    true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Upgrade":             true,
+}
+
+// serveProxy forwards the request to one of the mount's upstreams and
+// streams the answer back. The path is passed on unchanged. Host is
+// set to the upstream's address and X-Forwarded-For, -Host and -Proto
+// record where the request came from.
+func (s *site) serveProxy(c net.Conn, b *bytes.Buffer, req *request, m mount) {
+	if _, ok := req.header["Transfer-Encoding"]; ok {
+		sendError(b, "411 Length Required")
+		return
+	}
+	clen, _ := strconv.ParseInt(req.header["Content-Length"], 10, 64)
+	if clen < 0 {
+		clen = 0
+	}
+
+	head := proxyHead(c, req)
+	var (
+		up   *upstream
+		conn net.Conn
+		err  error
+	)
+	// Only a failed dial is retried on the next upstream; after that
+	// the body has been consumed.
+	for _, u := range m.proxy.pick() {
+		conn, err = net.DialTimeout("tcp", u.addr, m.proxy.timeout)
+		if err == nil {
+			up = u
+			break
+		}
+		log.Printf("Upstream %s: %v", u.addr, err)
+		m.proxy.markFailed(u)
+	}
+	if up == nil {
+		sendError(b, "502 Bad Gateway")
+		return
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(m.proxy.timeout))
+	fmt.Fprintf(conn, "%sHost: %s\r\nConnection: close\r\n\r\n", head, up.addr)
+	if _, err := io.CopyN(conn, req.body, clen); err != nil {
+		sendError(b, "400 Bad Request")
+		return
+	}
+
+	upResp := bufio.NewReader(conn)
+	status, fields, err := readUpstreamHead(upResp)
+	if err != nil {
+		log.Printf("Upstream %s: %v", up.addr, err)
+		m.proxy.markFailed(up)
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Timeout() {
+			sendError(b, "504 Gateway Timeout")
+		} else {
+			sendError(b, "502 Bad Gateway")
+		}
+		return
+	}
+	m.proxy.markOK(up)
+
+	// The body may take as long as it takes, e.g. a stream.
+	conn.SetDeadline(time.Time{})
+
+	// A body ended by the upstream closing is chunked for HTTP/1.1
+	// clients, so they can tell a complete one from a broken one. A
+	// chunked body is relayed as it is, except to HTTP/1.0 clients,
+	// which don't know the coding and get it decoded.
+	var (
+		body io.Reader = upResp
+		cw   *chunkedWriter
+	)
+	framing := bodyFraming(fields)
+	switch {
+	case framing == "" && req.proto == "HTTP/1.1" && req.method != "HEAD" && bodyAllowed(status):
+		cw = newChunkedWriter(c)
+		fields = append(fields, "Transfer-Encoding: chunked")
+	case framing == "chunked" && req.proto != "HTTP/1.1":
+		body = newChunkedReader(upResp)
+		fields = slices.DeleteFunc(fields, func(f string) bool {
+			name, _, _ := strings.Cut(f, ":")
+			return textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name)) == "Transfer-Encoding"
+		})
+	}
+
+	var out bytes.Buffer
+	out.WriteString("HTTP/1.1 " + status + "\r\n")
+	for _, f := range fields {
+		out.WriteString(f + "\r\n")
+	}
+	out.WriteString("Connection: close\r\n\r\n")
+	if _, err := out.WriteTo(c); err != nil {
+		return
+	}
+	if cw == nil {
+		io.Copy(c, body)
+		return
+	}
+	if _, err := io.Copy(cw, body); err == nil {
+		cw.Close()
+	}
+}
+
+// bodyFraming tells how an upstream response's body is delimited:
+// "length" by Content-Length, "chunked" by the chunked coding, or ""
+// by the upstream closing the connection.
+func bodyFraming(fields []string) string {
+	framing := ""
+	for _, f := range fields {
+		name, value, _ := strings.Cut(f, ":")
+		switch textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name)) {
+		case "Transfer-Encoding":
+			// chunked must be the final coding (RFC 9112, 6.1)
+			codings := strings.Split(value, ",")
+			if strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked") {
+				return "chunked"
+			}
+		case "Content-Length":
+			framing = "length"
+		}
+	}
+	return framing
+}
+
+// proxyHead renders the request line and the end-to-end header fields
+// for the upstream, leaving Host and Connection to the caller. The
+// target is rebuilt from the decoded, cleaned path that picked the
+// mount and auth rule, never passed on as sent: the upstream could
+// decode something like /api/a%2F..%2Fprivate differently.
+func proxyHead(c net.Conn, req *request) string {
+	target := escapePath(req.path)
+	if req.query != "" {
+		target += "?" + req.query
+	}
+	var h strings.Builder
+	h.WriteString(req.method + " " + target + " HTTP/1.1\r\n")
+
+	clientIP, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+	fields := maps.Clone(req.header)
+	if prior := fields["X-Forwarded-For"]; prior != "" {
+		clientIP = prior + ", " + clientIP
+	}
+	fields["X-Forwarded-For"] = clientIP
+	fields["X-Forwarded-Proto"] = "http"
+	if host := req.header["Host"]; host != "" {
+		fields["X-Forwarded-Host"] = host
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(fields)) {
+		if hopByHop[name] || name == "Host" {
+			continue
+		}
+		h.WriteString(name + ": " + fields[name] + "\r\n")
+	}
+	return h.String()
+}
+
+// readUpstreamHead reads the upstream's status line and header
+// fields, dropping the hop-by-hop ones. Transfer-Encoding is kept as
+// the body is relayed byte for byte, chunk framing included.
+func readUpstreamHead(r *bufio.Reader) (status string, fields []string, err error) {
+	line, err := readLine(r)
+	if err != nil {
+		return "", nil, err
+	}
+	proto, status, ok := strings.Cut(line, " ")
+	if !ok || !strings.HasPrefix(proto, "HTTP/") {
+		return "", nil, fmt.Errorf("bad status line %q", line)
+	}
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			return "", nil, err
+		}
+		if line == "" {
+			return status, fields, nil
+		}
+		name, _, ok := strings.Cut(line, ":")
+		if !ok {
+			return "", nil, fmt.Errorf("bad header line %q", line)
+		}
+		if hopByHop[textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name))] {
+			continue
+		}
+		fields = append(fields, line)
+	}
+}
+
+// proxyFlag collects repeated -proxy /prefix=host:port[,host:port]
+// flags.
+type proxyFlag []mount
+
+func (f *proxyFlag) String() string {
+	var parts []string
+	for _, m := range *f {
+		parts = append(parts, m.prefix)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f *proxyFlag) Set(v string) error {
+	prefix, list, ok := strings.Cut(v, "=")
+	if !ok || !strings.HasPrefix(prefix, "/") || list == "" {
+		return fmt.Errorf("want /prefix=host:port[,host:port], got %q", v)
+	}
+	addrs := strings.Split(list, ",")
+	for _, addr := range addrs {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("upstream %q: %v", addr, err)
+		}
+	}
+	pool := newUpstreamPool(addrs, 30*time.Second)
+	*f = append(*f, mount{prefix: cleanPath(prefix), proxy: pool})
+	return nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeUpstream answers every request with its own name and passes the
+// request head it received to heads.
+func fakeUpstream(t *testing.T, name string, heads chan<- string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				r := bufio.NewReader(c)
+				var head strings.Builder
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					head.WriteString(line)
+					if line == "\r\n" {
+						break
+					}
+				}
+				heads <- head.String()
+				c.Write([]byte("HTTP/1.1 200 OK\r\n" +
+					"Content-Type: text/plain\r\n" +
+					"Content-Length: " + strconv.Itoa(len(name)) + "\r\n" +
+					"Connection: keep-alive\r\n" +
+					"Keep-Alive: timeout=5\r\n\r\n" + name))
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// deadAddr returns a loopback address nothing listens on.
+func deadAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+func proxyServer(pool *upstreamPool) *server {
+	return &server{def: &site{
+		root:   "testdata",
+		mounts: []mount{{prefix: "/api/", proxy: pool}},
+	}}
+}
+
+func TestProxyRewritesHeaders(t *testing.T) {
+	heads := make(chan string, 1)
+	addr := fakeUpstream(t, "one", heads)
+	s := proxyServer(newUpstreamPool([]string{addr}, time.Second))
+
+	resp := roundTrip(t, s, "GET /api/users%20all?page=2 HTTP/1.1\r\n"+
+		"Host: front.internal\r\n"+
+		"X-Forwarded-For: 10.1.1.1\r\n"+
+		"Connection: keep-alive\r\n"+
+		"Proxy-Authorization: Basic eA==\r\n"+
+		"Accept: text/plain\r\n\r\n")
+	head := <-heads
+
+	if got := firstLine(head); got != "GET /api/users%20all?page=2 HTTP/1.1" {
+		t.Errorf("Request line: got %q", got)
+	}
+	for name, want := range map[string]string{
+		"Host":                addr,
+		"X-Forwarded-For":     "10.1.1.1, 127.0.0.1",
+		"X-Forwarded-Proto":   "http",
+		"X-Forwarded-Host":    "front.internal",
+		"Accept":              "text/plain",
+		"Connection":          "close",
+		"Proxy-Authorization": "",
+	} {
+		if got := headerValue(head, name); got != want {
+			t.Errorf("Upstream saw %s: %q, want %q", name, got, want)
+		}
+	}
+
+	if !strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n") || !strings.HasSuffix(resp, "\r\n\r\none") {
+		t.Errorf("Got response %q", resp)
+	}
+	if got := headerValue(resp, "Connection"); got != "close" {
+		t.Errorf("Client saw Connection: %q, want close", got)
+	}
+	if got := headerValue(resp, "Keep-Alive"); got != "" {
+		t.Errorf("Client saw Keep-Alive: %q", got)
+	}
+}
+
+func TestProxyTarget(t *testing.T) {
+	heads := make(chan string, 1)
+	s := proxyServer(newUpstreamPool([]string{fakeUpstream(t, "one", heads)}, time.Second))
+
+	testcases := []struct {
+		target string
+		want   string
+	}{
+		{"/api/users%20all?page=2", "/api/users%20all?page=2"},
+		{"/api/public%2F..%2Fprivate", "/api/private"},
+		{"/api/a/%2e%2e/b?x=%2F", "/api/b?x=%2F"},
+		{"/api//double", "/api/double"},
+		{"/api/what%3F", "/api/what%3F"},
+		{"http://front.internal/api/abs?q=1", "/api/abs?q=1"},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.target, func(t *testing.T) {
+			roundTrip(t, s, "GET "+tc.target+" HTTP/1.1\r\nHost: front.internal\r\n\r\n")
+			if got := firstLine(<-heads); got != "GET "+tc.want+" HTTP/1.1" {
+				t.Errorf("Upstream saw %q, want target %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestProxyRoundRobin(t *testing.T) {
+	heads := make(chan string, 10)
+	a := fakeUpstream(t, "a", heads)
+	b := fakeUpstream(t, "b", heads)
+	s := proxyServer(newUpstreamPool([]string{a, b}, time.Second))
+
+	var got []string
+	for range 4 {
+		resp := roundTrip(t, s, "GET /api/ HTTP/1.1\r\nHost: test\r\n\r\n")
+		<-heads
+		_, body, _ := strings.Cut(resp, "\r\n\r\n")
+		got = append(got, body)
+	}
+	if strings.Join(got, "") != "abab" {
+		t.Errorf("Got upstream order %v, want a b a b", got)
+	}
+}
+
+func TestProxyPassiveHealth(t *testing.T) {
+	heads := make(chan string, 10)
+	dead := deadAddr(t)
+	live := fakeUpstream(t, "live", heads)
+	pool := newUpstreamPool([]string{dead, live}, time.Second)
+	s := proxyServer(pool)
+
+	// Every request still succeeds, the dead upstream is skipped over.
+	for range 4 {
+		resp := roundTrip(t, s, "GET /api/ HTTP/1.1\r\nHost: test\r\n\r\n")
+		<-heads
+		if !strings.HasSuffix(resp, "\r\n\r\nlive") {
+			t.Fatalf("Got %q", resp)
+		}
+	}
+	if pool.upstreams[0].healthy(time.Now()) {
+		t.Error("Dead upstream is still considered healthy")
+	}
+	if !pool.upstreams[1].healthy(time.Now()) {
+		t.Error("Live upstream was marked down")
+	}
+}
+
+func TestProxyAllDown(t *testing.T) {
+	s := proxyServer(newUpstreamPool([]string{deadAddr(t)}, time.Second))
+	resp := roundTrip(t, s, "GET /api/ HTTP/1.1\r\nHost: test\r\n\r\n")
+	if !strings.HasPrefix(resp, "HTTP/1.1 502 Bad Gateway\r\n") {
+		t.Errorf("Got %q, want 502", firstLine(resp))
+	}
+}
+
+// rawUpstream answers every request with resp and closes.
+func rawUpstream(t *testing.T, resp string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			r := bufio.NewReader(c)
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil || line == "\r\n" {
+					break
+				}
+			}
+			c.Write([]byte(resp))
+			c.Close()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestProxyChunking(t *testing.T) {
+	const (
+		closed  = "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\nstreamed"
+		chunked = "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n8\r\nstreamed\r\n0\r\n\r\n"
+		sized   = "HTTP/1.1 200 OK\r\nContent-Length: 8\r\n\r\nstreamed"
+		empty   = "HTTP/1.1 204 No Content\r\n\r\n"
+	)
+	testcases := []struct {
+		name     string
+		upstream string
+		proto    string
+		te       string
+		body     string
+	}{
+		{name: "close delimited to HTTP/1.1", upstream: closed, proto: "HTTP/1.1", te: "chunked", body: "8\r\nstreamed\r\n0\r\n\r\n"},
+		{name: "close delimited to HTTP/1.0", upstream: closed, proto: "HTTP/1.0", body: "streamed"},
+		{name: "chunked to HTTP/1.1", upstream: chunked, proto: "HTTP/1.1", te: "chunked", body: "8\r\nstreamed\r\n0\r\n\r\n"},
+		{name: "chunked to HTTP/1.0", upstream: chunked, proto: "HTTP/1.0", body: "streamed"},
+		{name: "sized", upstream: sized, proto: "HTTP/1.1", body: "streamed"},
+		{name: "no content", upstream: empty, proto: "HTTP/1.1"},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := proxyServer(newUpstreamPool([]string{rawUpstream(t, tc.upstream)}, time.Second))
+			resp := roundTrip(t, s, "GET /api/ "+tc.proto+"\r\nHost: test\r\n\r\n")
+			if got := headerValue(resp, "Transfer-Encoding"); got != tc.te {
+				t.Errorf("Transfer-Encoding: got %q, want %q", got, tc.te)
+			}
+			if _, body, _ := strings.Cut(resp, "\r\n\r\n"); body != tc.body {
+				t.Errorf("Got body %q, want %q", body, tc.body)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// errUnsatisfiable is a range that starts past the end of the file.
+var errUnsatisfiable = errors.New("range not satisfiable")
+
+// parseRange reads a Range field asking for one range of bytes of a
+// size byte file (RFC 9110, 14.1.2): "bytes=first-last", "bytes=first-"
+// or "bytes=-suffix". It returns the first and last byte offsets,
+// inclusive. Other units, several ranges and bad syntax are errors
+// the caller answers by sending the whole file, as the RFC allows.
+func parseRange(field string, size int64) (first, last int64, err error) {
+	unit, spec, ok := strings.Cut(field, "=")
+	if !ok || !strings.EqualFold(strings.TrimSpace(unit), "bytes") {
+		return 0, 0, fmt.Errorf("unit %q is not bytes", unit)
+	}
+	spec = strings.TrimSpace(spec)
+	if strings.Contains(spec, ",") {
+		return 0, 0, fmt.Errorf("several ranges %q", spec)
+	}
+	from, to, ok := strings.Cut(spec, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("range %q has no dash", spec)
+	}
+
+	if from == "" {
+		n, err := parseOffset(to)
+		if err != nil {
+			return 0, 0, err
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, errUnsatisfiable
+		}
+		return max(size-n, 0), size - 1, nil
+	}
+
+	first, err = parseOffset(from)
+	if err != nil {
+		return 0, 0, err
+	}
+	last = size - 1
+	if to != "" {
+		if last, err = parseOffset(to); err != nil {
+			return 0, 0, err
+		}
+		if last < first {
+			return 0, 0, fmt.Errorf("range %q ends before it starts", spec)
+		}
+	}
+	if first >= size {
+		return 0, 0, errUnsatisfiable
+	}
+	return first, min(last, size-1), nil
+}
+
+// parseOffset reads an unsigned decimal, without the sign and spaces
+// strconv would let through.
+func parseOffset(s string) (int64, error) {
+	if s == "" || strings.TrimLeft(s, "0123456789") != "" {
+		return 0, fmt.Errorf("bad offset %q", s)
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+// sendRange answers a request with a Range field with the part of
+// data it asks for, 206, or with 416 when that starts past the end.
+// It writes nothing and returns false when the whole of data should
+// be sent instead: no Range, one that can't be honoured, or an
+// If-Range, which never matches as files carry no validators.
+func sendRange(b *bytes.Buffer, req *request, ctype string, data []byte, extra ...string) bool {
+	field, ok := req.header["Range"]
+	if !ok {
+		return false
+	}
+	if _, ok := req.header["If-Range"]; ok {
+		return false
+	}
+	size := int64(len(data))
+	first, last, err := parseRange(field, size)
+	switch {
+	case errors.Is(err, errUnsatisfiable):
+		status := "416 Range Not Satisfiable"
+		buildResp(b, status, "text/plain", strconv.Itoa(len(status)),
+			fmt.Sprintf("Content-Range: bytes */%d", size))
+		b.WriteString(status)
+		return true
+	case err != nil:
+		return false
+	}
+
+	part := data[first : last+1]
+	extra = append(extra, fmt.Sprintf("Content-Range: bytes %d-%d/%d", first, last, size))
+	buildResp(b, "206 Partial Content", ctype, strconv.Itoa(len(part)), extra...)
+	b.Write(part)
+	return true
+}
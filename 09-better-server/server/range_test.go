@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+	testcases := []struct {
+		field       string
+		size        int64
+		first, last int64
+		wantErr     error // errAny for any other error
+	}{
+		{field: "bytes=0-499", size: 1000, first: 0, last: 499},
+		{field: "bytes=500-", size: 1000, first: 500, last: 999},
+		{field: "bytes=-200", size: 1000, first: 800, last: 999},
+		{field: "bytes=-2000", size: 1000, first: 0, last: 999},
+		{field: "bytes=900-2000", size: 1000, first: 900, last: 999},
+		{field: "Bytes = 7-7", size: 10, first: 7, last: 7},
+		{field: "bytes=1000-", size: 1000, wantErr: errUnsatisfiable},
+		{field: "bytes=-0", size: 1000, wantErr: errUnsatisfiable},
+		{field: "bytes=-5", size: 0, wantErr: errUnsatisfiable},
+		{field: "bytes=0-0", size: 0, wantErr: errUnsatisfiable},
+		{field: "bytes=5-4", size: 10, wantErr: errAny},
+		{field: "bytes=0-1,4-5", size: 10, wantErr: errAny},
+		{field: "bytes=+1-2", size: 10, wantErr: errAny},
+		{field: "bytes= 1-2 ", size: 10, first: 1, last: 2},
+		{field: "bytes=1 -2", size: 10, wantErr: errAny},
+		{field: "bytes=a-b", size: 10, wantErr: errAny},
+		{field: "bytes=-", size: 10, wantErr: errAny},
+		{field: "bytes=5", size: 10, wantErr: errAny},
+		{field: "items=0-1", size: 10, wantErr: errAny},
+		{field: "bytes=99999999999999999999-", size: 10, wantErr: errAny},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.field, func(t *testing.T) {
+			first, last, err := parseRange(tc.field, tc.size)
+			switch {
+			case tc.wantErr == errAny:
+				if err == nil || errors.Is(err, errUnsatisfiable) {
+					t.Errorf("Got %d-%d, %v; want a syntax error", first, last, err)
+				}
+			case !errors.Is(err, tc.wantErr):
+				t.Errorf("Got %d-%d, %v; want error %v", first, last, err, tc.wantErr)
+			case err == nil && (first != tc.first || last != tc.last):
+				t.Errorf("Got %d-%d, want %d-%d", first, last, tc.first, tc.last)
+			}
+		})
+	}
+}
+
+// errAny stands for any error but errUnsatisfiable in test tables.
+var errAny = errors.New("any error")
+
+func TestServeRange(t *testing.T) {
+	root := t.TempDir()
+	page := strings.Repeat("0123456789", 100)
+	files := map[string]string{
+		"page.html":    page,
+		"page.html.gz": "pretend gzip",
+		"notes.txt":    page,
+		"blob.bin":     "opaque",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := &server{def: &site{root: root}}
+
+	testcases := []struct {
+		name     string
+		path     string
+		header   string
+		status   string
+		crange   string
+		encoding string
+		body     string
+	}{
+		{
+			name: "first bytes", path: "/notes.txt", header: "Range: bytes=0-9\r\n",
+			status: "206 Partial Content", crange: "bytes 0-9/1000", body: "0123456789",
+		},
+		{
+			name: "suffix", path: "/notes.txt", header: "Range: bytes=-3\r\n",
+			status: "206 Partial Content", crange: "bytes 997-999/1000", body: "789",
+		},
+		{
+			// Without gzip the range is of the file as is.
+			name: "compressible", path: "/notes.txt", header: "Range: bytes=995-\r\n",
+			status: "206 Partial Content", crange: "bytes 995-999/1000", body: "56789",
+		},
+		{
+			name: "precompressed sibling", path: "/page.html", header: "Range: bytes=8-\r\nAccept-Encoding: gzip\r\n",
+			status: "206 Partial Content", crange: "bytes 8-11/12", encoding: "gzip", body: "gzip",
+		},
+		{
+			name: "past the end", path: "/notes.txt", header: "Range: bytes=1000-\r\n",
+			status: "416 Range Not Satisfiable", crange: "bytes */1000",
+		},
+		{
+			name: "several ranges", path: "/notes.txt", header: "Range: bytes=0-1,5-6\r\n",
+			status: "200 OK", body: page,
+		},
+		{
+			name: "if-range", path: "/notes.txt", header: "Range: bytes=0-1\r\nIf-Range: \"v1\"\r\n",
+			status: "200 OK", body: page,
+		},
+		{
+			name: "no range", path: "/blob.bin", status: "200 OK", body: "opaque",
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := roundTrip(t, s, "GET "+tc.path+" HTTP/1.1\r\nHost: test\r\n"+tc.header+"\r\n")
+			head, body, _ := strings.Cut(resp, "\r\n\r\n")
+
+			if got := firstLine(resp); got != "HTTP/1.1 "+tc.status {
+				t.Fatalf("Got %q, want status %s", got, tc.status)
+			}
+			if got := headerValue(head, "Content-Range"); got != tc.crange {
+				t.Errorf("Got Content-Range %q, want %q", got, tc.crange)
+			}
+			if got := headerValue(head, "Content-Encoding"); got != tc.encoding {
+				t.Errorf("Got Content-Encoding %q, want %q", got, tc.encoding)
+			}
+			if tc.body != "" && body != tc.body {
+				t.Errorf("Got body %q, want %q", body, tc.body)
+			}
+			if tc.status != "416 Range Not Satisfiable" && headerValue(head, "Accept-Ranges") != "bytes" {
+				t.Errorf("Head %q lacks Accept-Ranges: bytes", head)
+			}
+		})
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net/textproto"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// request holds the parts of an HTTP request the server cares about.
+type request struct {
+	method string
+	target string // request-target as sent, e.g. /dir%201/?sort=size
+	path   string // decoded and cleaned path, always starts with "/"
+	query  string // raw query string without the "?"
+	proto  string // HTTP/1.0, HTTP/1.1
+	header map[string]string
+	body   io.Reader // whatever follows the header block
+
+	redirects int // local CGI redirects followed to get here
+}
+
+var errBadRequest = errors.New("malformed request")
+
+// Largest request head, the request line and header block, read
+// before giving up on the client with errHeadTooLarge.
+const maxHead = 64 << 10
+
+var errHeadTooLarge = errors.New("request head too large")
+
+// parseReq reads the request line and the header block, leaving the
+// body unread in req.body. Header names are canonicalized (accept ->
+// Accept) and repeated fields are joined with ", ". A head longer
+// than maxHead is errHeadTooLarge.
+func parseReq(in io.Reader) (*request, error) {
+	limit := &headLimit{r: in, left: maxHead}
+	reader := bufio.NewReader(limit)
+
+	// example: GET /file2.html HTTP/1.1
+	line, err := readLine(reader)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Fields(line)
+	if len(parts) < 2 {
+		return nil, errBadRequest
+	}
+
+	req := &request{
+		method: parts[0],
+		target: parts[1],
+		proto:  "HTTP/1.0",
+		header: make(map[string]string),
+		body:   reader,
+	}
+	if len(parts) > 2 {
+		req.proto = parts[2]
+	}
+	authority, urlPath, query, err := parseTarget(req.target)
+	if err != nil {
+		return nil, err
+	}
+	req.path, req.query = urlPath, query
+
+	for {
+		line, err := readLine(reader)
+		if err != nil {
+			return nil, err
+		}
+		if line == "" {
+			break
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, errBadRequest
+		}
+		name = textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name))
+		value = strings.TrimSpace(value)
+		// Repeated fields join into a list, skipping empty elements
+		// (RFC 9110, 5.6.1).
+		if prev := req.header[name]; prev != "" && value != "" {
+			value = prev + ", " + value
+		} else if prev != "" {
+			value = prev
+		}
+		req.header[name] = value
+	}
+
+	// An absolute-form target names the host itself and wins over
+	// the Host field (RFC 9112, 3.2.2).
+	if authority != "" {
+		req.header["Host"] = authority
+	}
+	limit.lifted = true // the body has limits of its own
+	return req, nil
+}
+
+// headLimit fails reads past left bytes until lifted, so that a client
+// can't make parseReq buffer an endless line or header block.
+type headLimit struct {
+	r      io.Reader
+	left   int64
+	lifted bool
+}
+
+func (l *headLimit) Read(p []byte) (int, error) {
+	if l.lifted {
+		return l.r.Read(p)
+	}
+	if l.left <= 0 {
+		return 0, errHeadTooLarge
+	}
+	if int64(len(p)) > l.left {
+		p = p[:l.left]
+	}
+	n, err := l.r.Read(p)
+	l.left -= int64(n)
+	return n, err
+}
+
+// parseTarget splits a request-target into its authority (for the
+// absolute-form http://host/path only), decoded path and raw query.
+// The fragment is dropped. The path is percent-decoded and then
+// cleaned, so dot segments, including encoded ones like %2e%2e, can
+// never climb above "/". A trailing slash is kept since it tells a
+// directory request apart from a redirect.
+func parseTarget(target string) (authority, urlPath, query string, err error) {
+	target, _, _ = strings.Cut(target, "#")
+	rawPath, query, _ := strings.Cut(target, "?")
+
+	if !strings.HasPrefix(rawPath, "/") {
+		scheme, rest, ok := strings.Cut(rawPath, "://")
+		scheme = strings.ToLower(scheme)
+		if !ok || (scheme != "http" && scheme != "https") {
+			return "", "", "", errBadRequest
+		}
+		authority, rawPath, _ = strings.Cut(rest, "/")
+		if authority == "" {
+			return "", "", "", errBadRequest
+		}
+		rawPath = "/" + rawPath
+	}
+
+	urlPath, err = url.PathUnescape(rawPath)
+	if err != nil {
+		return "", "", "", errBadRequest
+	}
+	if strings.IndexByte(urlPath, 0) >= 0 {
+		return "", "", "", errBadRequest
+	}
+	return authority, cleanPath(urlPath), query, nil
+}
+
+// cleanPath is path.Clean that keeps a trailing slash.
+func cleanPath(p string) string {
+	cleaned := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// escapePath turns a decoded path back into one that is safe to put
+// in a Location header or link.
+func escapePath(p string) string {
+	return (&url.URL{Path: p}).EscapedPath()
+}
+
+// readLine returns one line without its trailing CRLF (or bare LF).
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimSuffix(line, "\n")
+	return strings.TrimSuffix(line, "\r"), nil
+}
+
+// preferredType picks the media type from offers that the Accept
+// header ranks highest. Ties go to the earlier offer, and a missing
+// Accept header means the first offer.
+func preferredType(accept string, offers ...string) string {
+	if len(offers) == 0 {
+		return ""
+	}
+	if accept == "" {
+		return offers[0]
+	}
+	best, bestQ := offers[0], -1.0
+	for _, offer := range offers {
+		q := acceptQuality(accept, offer)
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// acceptQuality returns the q-value the Accept header gives to
+// mediaType, honoring exact, type/* and */* ranges in that order of
+// specificity.
+func acceptQuality(accept, mediaType string) float64 {
+	major, _, _ := strings.Cut(mediaType, "/")
+	q, specificity := 0.0, -1
+	for _, field := range strings.Split(accept, ",") {
+		rng, params, _ := strings.Cut(strings.TrimSpace(field), ";")
+		rng = strings.ToLower(strings.TrimSpace(rng))
+
+		var s int
+		switch rng {
+		case mediaType:
+			s = 2
+		case major + "/*":
+			s = 1
+		case "*/*":
+			s = 0
+		default:
+			continue
+		}
+		if s > specificity {
+			specificity, q = s, parseQ(params)
+		}
+	}
+	return q
+}
+
+// parseQ extracts q=0.x from a parameter list, defaulting to 1.
+func parseQ(params string) float64 {
+	for _, p := range strings.Split(params, ";") {
+		name, value, ok := strings.Cut(strings.TrimSpace(p), "=")
+		if !ok || strings.ToLower(name) != "q" {
+			continue
+		}
+		if q, err := strconv.ParseFloat(value, 64); err == nil {
+			return q
+		}
+	}
+	return 1
+}
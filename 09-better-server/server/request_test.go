@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseTarget(t *testing.T) {
+	testcases := []struct {
+		target    string
+		authority string
+		path      string
+		query     string
+		wantErr   bool
+	}{
+		{target: "/file1.txt", path: "/file1.txt"},
+		{target: "/file%201.txt", path: "/file 1.txt"},
+		{target: "/file1.txt?v=2", path: "/file1.txt", query: "v=2"},
+		{target: "/file1.txt?v=2#top", path: "/file1.txt", query: "v=2"},
+		{target: "/file1.txt#top", path: "/file1.txt"},
+		{target: "/a+b.txt", path: "/a+b.txt"},
+		{target: "/dir/", path: "/dir/"},
+		{target: "/dir//sub/", path: "/dir/sub/"},
+		{target: "/", path: "/"},
+		{target: "/%E2%82%AC.txt", path: "/€.txt"},
+		{target: "/a/%2F/b", path: "/a/b"},
+
+		// Dot segments never climb above the root.
+		{target: "/../etc/passwd", path: "/etc/passwd"},
+		{target: "/a/../../etc/passwd", path: "/etc/passwd"},
+		{target: "/%2e%2e/%2e%2e/etc/passwd", path: "/etc/passwd"},
+		{target: "/a/%2E%2E/b", path: "/b"},
+		{target: "/..%2f..%2fetc/passwd", path: "/etc/passwd"},
+		{target: "/./file1.txt", path: "/file1.txt"},
+
+		// absolute-form
+		{target: "http://example.com/file1.txt", authority: "example.com", path: "/file1.txt"},
+		{target: "HTTP://example.com:8080/a%20b?x=1", authority: "example.com:8080", path: "/a b", query: "x=1"},
+		{target: "http://example.com", authority: "example.com", path: "/"},
+		{target: "http://example.com?x=1", authority: "example.com", path: "/", query: "x=1"},
+		{target: "http://example.com/../../x", authority: "example.com", path: "/x"},
+
+		// Rejected
+		{target: "/file%00.txt", wantErr: true},
+		{target: "/file\x00.txt", wantErr: true},
+		{target: "/bad%zzescape", wantErr: true},
+		{target: "/trailing%", wantErr: true},
+		{target: "file1.txt", wantErr: true},
+		{target: "*", wantErr: true},
+		{target: "ftp://example.com/x", wantErr: true},
+		{target: "http:///x", wantErr: true},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.target, func(t *testing.T) {
+			authority, path, query, err := parseTarget(tc.target)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("Expected error, got path %q", path)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if authority != tc.authority {
+				t.Errorf("Authority mismatch! Got %q, want %q", authority, tc.authority)
+			}
+			if path != tc.path {
+				t.Errorf("Path mismatch! Got %q, want %q", path, tc.path)
+			}
+			if query != tc.query {
+				t.Errorf("Query mismatch! Got %q, want %q", query, tc.query)
+			}
+		})
+	}
+}
+
+func TestParseReq(t *testing.T) {
+	testcases := []struct {
+		name    string
+		raw     string
+		method  string
+		path    string
+		query   string
+		host    string
+		wantErr bool
+	}{
+		{
+			name:   "simple",
+			raw:    "GET /file2.html HTTP/1.1\r\nHost: localhost\r\n\r\n",
+			method: "GET", path: "/file2.html", host: "localhost",
+		},
+		{
+			name:   "encoded with query",
+			raw:    "GET /file%201.txt?v=2 HTTP/1.1\r\nHost: localhost\r\n\r\n",
+			method: "GET", path: "/file 1.txt", query: "v=2", host: "localhost",
+		},
+		{
+			name:   "absolute-form overrides Host",
+			raw:    "GET http://other:8080/x HTTP/1.1\r\nHost: localhost\r\n\r\n",
+			method: "GET", path: "/x", host: "other:8080",
+		},
+		{
+			name:   "bare LF",
+			raw:    "GET / HTTP/1.0\nhost: localhost\n\n",
+			method: "GET", path: "/", host: "localhost",
+		},
+		{
+			name:   "empty repeated field",
+			raw:    "GET / HTTP/1.1\r\nHost:\r\nHost: localhost\r\n\r\n",
+			method: "GET", path: "/", host: "localhost",
+		},
+		{name: "blank request line", raw: "\r\n\r\n", wantErr: true},
+		{name: "no target", raw: "GET\r\n\r\n", wantErr: true},
+		{name: "encoded NUL", raw: "GET /%00 HTTP/1.1\r\n\r\n", wantErr: true},
+		{name: "bad header", raw: "GET / HTTP/1.1\r\nno colon\r\n\r\n", wantErr: true},
+		{name: "truncated", raw: "GET / HTTP/1.1\r\nHost: x\r\n", wantErr: true},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := parseReq(strings.NewReader(tc.raw))
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("Expected error, got %+v", req)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if req.method != tc.method || req.path != tc.path || req.query != tc.query {
+				t.Errorf("Got %s %q ?%q, want %s %q ?%q",
+					req.method, req.path, req.query, tc.method, tc.path, tc.query)
+			}
+			if req.header["Host"] != tc.host {
+				t.Errorf("Host mismatch! Got %q, want %q", req.header["Host"], tc.host)
+			}
+		})
+	}
+}
+
+// formatReq writes the request head back out.
+func TestParseReqHeadLimit(t *testing.T) {
+	testcases := []struct {
+		name    string
+		raw     string
+		wantErr error
+	}{
+		{name: "long request line", raw: "GET /" + strings.Repeat("a", maxHead) + " HTTP/1.1\r\n\r\n", wantErr: errHeadTooLarge},
+		{name: "long field", raw: "GET / HTTP/1.1\r\nX: " + strings.Repeat("a", maxHead) + "\r\n\r\n", wantErr: errHeadTooLarge},
+		{name: "many fields", raw: "GET / HTTP/1.1\r\n" + strings.Repeat("X: a\r\n", maxHead/6+1) + "\r\n", wantErr: errHeadTooLarge},
+		{name: "just fits", raw: "GET / HTTP/1.1\r\nX: " + strings.Repeat("a", maxHead-25) + "\r\n\r\n"},
+		// The limit is on the head; the body has its own.
+		{name: "large body", raw: "PUT / HTTP/1.1\r\nContent-Length: 200000\r\n\r\n" + strings.Repeat("b", 200000)},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := parseReq(strings.NewReader(tc.raw))
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("Got %v, want %v", err, tc.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			_, body, _ := strings.Cut(tc.raw, "\r\n\r\n")
+			if got, err := io.ReadAll(req.body); err != nil || string(got) != body {
+				t.Errorf("Read %d body bytes, %v; want %d", len(got), err, len(body))
+			}
+		})
+	}
+
+	s := &server{def: &site{root: t.TempDir()}}
+	resp := roundTrip(t, s, "GET / HTTP/1.1\r\nX: "+strings.Repeat("a", 4*maxHead)+"\r\n\r\n")
+	if got := firstLine(resp); got != "HTTP/1.1 431 Request Header Fields Too Large" {
+		t.Errorf("Got %q, want 431", got)
+	}
+}
+
+func formatReq(req *request) string {
+	var b strings.Builder
+	b.WriteString(req.method + " " + req.target + " " + req.proto + "\r\n")
+	for _, name := range slices.Sorted(maps.Keys(req.header)) {
+		b.WriteString(name + ": " + req.header[name] + "\r\n")
+	}
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+func FuzzParseReq(f *testing.F) {
+	for _, seed := range []string{
+		"GET /file1.txt HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		"GET /a%20b/../c?x=1#frag HTTP/1.0\r\nAccept: text/html;q=0.9, */*\r\n\r\n",
+		"PUT /up/x HTTP/1.1\r\nContent-Length: 3\r\nX-A: 1\r\nx-a: 2\r\n\r\nabc",
+		"GET http://Example.COM:8080/p HTTP/1.1\r\nHost: other\r\n\r\n",
+		"GET /\n\n",
+		"\r\n\r\n",
+		"GET\r\n\r\n",
+		"GET /%00 HTTP/1.1\r\n\r\n",
+		"GET / HTTP/1.1\r\nbroken header\r\n\r\n",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, raw string) {
+		req, err := parseReq(strings.NewReader(raw))
+		if err != nil {
+			return
+		}
+		if req.method == "" || !strings.HasPrefix(req.path, "/") {
+			t.Fatalf("Parsed %q into method %q path %q", raw, req.method, req.path)
+		}
+		if strings.Contains(req.path, "/../") || strings.HasSuffix(req.path, "/..") {
+			t.Fatalf("Path %q climbs out of the root", req.path)
+		}
+
+		head := formatReq(req)
+		again, err := parseReq(strings.NewReader(head))
+		if err != nil {
+			t.Fatalf("Reparsing %q: %v", head, err)
+		}
+		if again.method != req.method || again.target != req.target || again.proto != req.proto ||
+			again.path != req.path || again.query != req.query || !maps.Equal(again.header, req.header) {
+			t.Fatalf("Round trip changed %+v into %+v", req, again)
+		}
+	})
+}
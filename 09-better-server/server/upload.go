@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// handlePut stores the request body at req.path. The body is streamed
+// into a temp file next to the target and renamed into place, so a
+// reader never sees a half written file. It answers 201 for a new
+// file and 204 for a replaced one.
+func (s *site) handlePut(b *bytes.Buffer, req *request) {
+	m, urlPath := s.locate(req.path)
+	if !m.writable {
+		sendError(b, "405 Method Not Allowed")
+		return
+	}
+	if strings.HasSuffix(urlPath, "/") {
+		sendError(b, "409 Conflict") // can't PUT a directory
+		return
+	}
+
+	if _, ok := req.header["Transfer-Encoding"]; ok {
+		sendError(b, "411 Length Required")
+		return
+	}
+	clen, err := strconv.ParseInt(req.header["Content-Length"], 10, 64)
+	if err != nil || clen < 0 {
+		sendError(b, "411 Length Required")
+		return
+	}
+	if clen > s.maxUpload {
+		sendError(b, "413 Content Too Large")
+		return
+	}
+
+	fpath, err := s.writablePath(m.root, urlPath)
+	if err != nil {
+		sendFileError(b, err)
+		return
+	}
+	status := "201 Created"
+	if info, err := os.Lstat(fpath); err == nil {
+		if info.IsDir() {
+			sendError(b, "409 Conflict")
+			return
+		}
+		status = "204 No Content"
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(fpath), ".upload-*")
+	if err != nil {
+		sendFileError(b, err)
+		return
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	n, err := io.Copy(tmp, io.LimitReader(req.body, clen))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && n < clen {
+		sendError(b, "400 Bad Request") // body shorter than Content-Length
+		return
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0o644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), fpath)
+	}
+	if err != nil {
+		sendError(b, "500 Internal Server Error")
+		return
+	}
+
+	s.events.publish(s, "put", req.path)
+	if status == "204 No Content" {
+		buildResp(b, status, "text/plain", "")
+		return
+	}
+	buildResp(b, status, "text/plain", strconv.Itoa(len(status)),
+		"Location: "+escapePath(req.path))
+	b.WriteString(status)
+}
+
+// handleDelete removes the file at req.path. Directories are left
+// alone with a 409.
+func (s *site) handleDelete(b *bytes.Buffer, req *request) {
+	m, urlPath := s.locate(req.path)
+	if !m.writable {
+		sendError(b, "405 Method Not Allowed")
+		return
+	}
+
+	fpath, err := s.writablePath(m.root, urlPath)
+	if err != nil {
+		sendFileError(b, err)
+		return
+	}
+	info, err := os.Lstat(fpath)
+	if err != nil {
+		sendFileError(b, err)
+		return
+	}
+	if info.IsDir() {
+		sendError(b, "409 Conflict")
+		return
+	}
+	if err := os.Remove(fpath); err != nil {
+		sendFileError(b, err)
+		return
+	}
+	s.events.publish(s, "delete", req.path)
+	buildResp(b, "204 No Content", "text/plain", "")
+}
+
+// writablePath maps urlPath to a file name under root for PUT and
+// DELETE. The file itself need not exist, so the policy checks its
+// directory, which must, and its name. A missing directory is a 409
+// as the client has to create it first.
+func (s *site) writablePath(root, urlPath string) (string, error) {
+	dir, name := path.Split(path.Clean(urlPath))
+	if name == "" || s.policy.hidden(name) || strings.HasPrefix(name, ".upload-") {
+		return "", fs.ErrNotExist
+	}
+	fdir, err := s.policy.resolve(root, dir)
+	if err == nil {
+		var info os.FileInfo
+		info, err = os.Stat(fdir)
+		if err == nil && !info.IsDir() {
+			err = errConflict
+		}
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		err = errConflict
+	}
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(fdir, name), nil
+}
+
+var errConflict = errors.New("parent is missing or not a directory")
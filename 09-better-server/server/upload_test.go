@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestPutDelete(t *testing.T) {
+	root, drops := t.TempDir(), t.TempDir()
+	os.Mkdir(filepath.Join(drops, "sub"), 0o755)
+	writeFile(t, drops, "old.txt", "old")
+	s := &server{def: &site{
+		root:      root,
+		mounts:    []mount{{prefix: "/drops/", root: drops, writable: true}},
+		maxUpload: 16,
+	}}
+
+	put := func(path, body string) string {
+		return "PUT " + path + " HTTP/1.1\r\nHost: test\r\n" +
+			"Content-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body
+	}
+	testcases := []struct {
+		name   string
+		raw    string
+		status string
+	}{
+		{"create", put("/drops/new.txt", "fresh"), "201 Created"},
+		{"create in subdir", put("/drops/sub/a%20b.txt", "spaced"), "201 Created"},
+		{"replace", put("/drops/old.txt", "newer"), "204 No Content"},
+		{"missing parent", put("/drops/nodir/x.txt", "x"), "409 Conflict"},
+		{"onto directory", put("/drops/sub", "x"), "409 Conflict"},
+		{"trailing slash", put("/drops/sub/", "x"), "409 Conflict"},
+		{"too large", put("/drops/big.txt", strings.Repeat("x", 17)), "413 Content Too Large"},
+		{"read-only root", put("/ro.txt", "x"), "405 Method Not Allowed"},
+		{"no length", "PUT /drops/n.txt HTTP/1.1\r\nHost: test\r\n\r\n", "411 Length Required"},
+		{"chunked", "PUT /drops/n.txt HTTP/1.1\r\nHost: test\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", "411 Length Required"},
+		{"short body", "PUT /drops/short.txt HTTP/1.1\r\nHost: test\r\nContent-Length: 10\r\n\r\nabc", "400 Bad Request"},
+		{"delete", "DELETE /drops/old.txt HTTP/1.1\r\nHost: test\r\n\r\n", "204 No Content"},
+		{"delete again", "DELETE /drops/old.txt HTTP/1.1\r\nHost: test\r\n\r\n", "404 File not found"},
+		{"delete directory", "DELETE /drops/sub HTTP/1.1\r\nHost: test\r\n\r\n", "409 Conflict"},
+		{"delete read-only", "DELETE /file.txt HTTP/1.1\r\nHost: test\r\n\r\n", "405 Method Not Allowed"},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := roundTrip(t, s, tc.raw)
+			if !strings.HasPrefix(resp, "HTTP/1.1 "+tc.status+"\r\n") {
+				t.Errorf("Got %q, want status %s", firstLine(resp), tc.status)
+			}
+		})
+	}
+
+	want := map[string]string{
+		"new.txt":     "fresh",
+		"sub/a b.txt": "spaced",
+	}
+	for name, data := range want {
+		got, err := os.ReadFile(filepath.Join(drops, name))
+		if err != nil || string(got) != data {
+			t.Errorf("%s: got %q (%v), want %q", name, got, err, data)
+		}
+	}
+	for _, name := range []string{"old.txt", "big.txt", "short.txt", "nodir"} {
+		if _, err := os.Stat(filepath.Join(drops, name)); err == nil {
+			t.Errorf("%s should not exist", name)
+		}
+	}
+	leftovers, _ := filepath.Glob(filepath.Join(drops, ".upload-*"))
+	if len(leftovers) != 0 {
+		t.Errorf("Temp files left behind: %v", leftovers)
+	}
+}
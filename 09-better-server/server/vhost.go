@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// vhost maps a Host pattern to the site serving it. A pattern is
+// either an exact name (docs.internal) or a wildcard for any
+// subdomain (*.example.com, which does not match example.com itself).
+type vhost struct {
+	pattern string
+	site    *site
+}
+
+// vhostFlag collects repeated -vhost name=dir flags.
+type vhostFlag []string
+
+func (f *vhostFlag) String() string { return strings.Join(*f, ",") }
+
+func (f *vhostFlag) Set(v string) error {
+	name, dir, ok := strings.Cut(v, "=")
+	if !ok || name == "" || dir == "" {
+		return fmt.Errorf("want name=dir, got %q", v)
+	}
+	if strings.Contains(strings.TrimPrefix(name, "*."), "*") {
+		return fmt.Errorf("wildcard must be a leading *., got %q", name)
+	}
+	*f = append(*f, v)
+	return nil
+}
+
+// siteFor picks the site for a request from its Host header. An exact
+// name beats a wildcard and a longer wildcard beats a shorter one.
+// Unknown hosts get the default site. HTTP/1.1 requires Host, so a
+// request without one gets nil.
+func (s *server) siteFor(req *request) *site {
+	host, ok := req.header["Host"]
+	if !ok {
+		if req.proto == "HTTP/1.1" {
+			return nil
+		}
+		return s.def
+	}
+	host = normalizeHost(host)
+
+	var best *vhost
+	for i, vh := range s.vhosts {
+		if vh.pattern == host {
+			return vh.site
+		}
+		suffix, ok := strings.CutPrefix(vh.pattern, "*")
+		if ok && strings.HasSuffix(host, suffix) && len(host) > len(suffix) {
+			if best == nil || len(vh.pattern) > len(best.pattern) {
+				best = &s.vhosts[i]
+			}
+		}
+	}
+	if best != nil {
+		return best.site
+	}
+	return s.def
+}
+
+// normalizeHost lowercases a Host value and strips the port and any
+// trailing dot, so "Docs.Internal.:8080" matches docs.internal.
+func normalizeHost(host string) string {
+	host = strings.ToLower(strings.TrimSpace(host))
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(host, ".")
+}
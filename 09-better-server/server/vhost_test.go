@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSiteFor(t *testing.T) {
+	def := &site{root: "default"}
+	docs := &site{root: "docs"}
+	wild := &site{root: "wild"}
+	deeper := &site{root: "deeper"}
+	s := &server{def: def, vhosts: []vhost{
+		{"*.example.com", wild},
+		{"docs.internal", docs},
+		{"*.api.example.com", deeper},
+	}}
+
+	testcases := []struct {
+		proto string
+		host  string // "-" means no Host field
+		want  *site
+	}{
+		{"HTTP/1.1", "docs.internal", docs},
+		{"HTTP/1.1", "DOCS.Internal:8080", docs},
+		{"HTTP/1.1", "docs.internal.", docs},
+		{"HTTP/1.1", "www.example.com", wild},
+		{"HTTP/1.1", "a.b.example.com", wild},
+		{"HTTP/1.1", "v1.api.example.com", deeper},
+		{"HTTP/1.1", "example.com", def},
+		{"HTTP/1.1", "notexample.com", def},
+		{"HTTP/1.1", "unknown", def},
+		{"HTTP/1.1", "127.0.0.1:28333", def},
+		{"HTTP/1.1", "-", nil},
+		{"HTTP/1.0", "-", def},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.proto+"/"+tc.host, func(t *testing.T) {
+			req := &request{proto: tc.proto, header: map[string]string{}}
+			if tc.host != "-" {
+				req.header["Host"] = tc.host
+			}
+			got := s.siteFor(req)
+			if got != tc.want {
+				t.Errorf("Got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestVhostServe(t *testing.T) {
+	defRoot, docsRoot := t.TempDir(), t.TempDir()
+	writeFile(t, defRoot, "which.txt", "default site")
+	writeFile(t, docsRoot, "which.txt", "docs site")
+	s := &server{
+		def:    &site{root: defRoot},
+		vhosts: []vhost{{"docs.internal", &site{root: docsRoot}}},
+	}
+
+	testcases := []struct {
+		raw    string
+		status string
+		body   string
+	}{
+		{"GET /which.txt HTTP/1.1\r\nHost: docs.internal\r\n\r\n", "200 OK", "docs site"},
+		{"GET /which.txt HTTP/1.1\r\nHost: other\r\n\r\n", "200 OK", "default site"},
+		{"GET http://docs.internal/which.txt HTTP/1.1\r\nHost: other\r\n\r\n", "200 OK", "docs site"},
+		{"GET /which.txt HTTP/1.0\r\n\r\n", "200 OK", "default site"},
+		{"GET /which.txt HTTP/1.1\r\n\r\n", "400 Bad Request", ""},
+	}
+	for _, tc := range testcases {
+		t.Run(firstLine(tc.raw), func(t *testing.T) {
+			resp := roundTrip(t, s, tc.raw)
+			if !strings.HasPrefix(resp, "HTTP/1.1 "+tc.status+"\r\n") {
+				t.Errorf("Got %q, want status %s", firstLine(resp), tc.status)
+			}
+			if tc.body != "" && !strings.HasSuffix(resp, "\r\n\r\n"+tc.body) {
+				t.Errorf("Got %q, want body %q", resp, tc.body)
+			}
+		})
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWSAccept(t *testing.T) {
+	// The example from RFC 6455, 1.3.
+	if got := wsAccept("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Got %q", got)
+	}
+}
+
+func wsServer(t *testing.T) string {
+	t.Helper()
+	s := &server{def: &site{root: t.TempDir()}, wsPrefix: "/ws/", room: newWSRoom()}
+	return startServer(t, s)
+}
+
+// dialWS opens a WebSocket to path and returns the client side.
+func dialWS(t *testing.T, addr, path string) *wsConn {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	c.Write([]byte("GET " + path + " HTTP/1.1\r\nHost: test\r\n" +
+		"Upgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n" +
+		"Sec-WebSocket-Version: 13\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n"))
+
+	r := bufio.NewReader(c)
+	var head strings.Builder
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		head.WriteString(line)
+		if line == "\r\n" {
+			break
+		}
+	}
+	if !strings.HasPrefix(head.String(), "HTTP/1.1 101 ") {
+		t.Fatalf("Handshake got %q", head.String())
+	}
+	if got := headerValue(head.String(), "Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Sec-WebSocket-Accept %q", got)
+	}
+	return &wsConn{c: c, r: r, client: true, maxMessage: wsMaxMessage}
+}
+
+// rawFrame builds a frame by hand, for what writeFrame won't send.
+func rawFrame(fin, masked bool, op byte, payload []byte) []byte {
+	b0 := op
+	if fin {
+		b0 |= 0x80
+	}
+	frame := []byte{b0, byte(len(payload))}
+	if !masked {
+		return append(frame, payload...)
+	}
+	frame[1] |= 0x80
+	var mask [4]byte
+	rand.Read(mask[:])
+	frame = append(frame, mask[:]...)
+	for i, c := range payload {
+		frame = append(frame, c^mask[i%4])
+	}
+	return frame
+}
+
+func TestWSEchoFragmented(t *testing.T) {
+	ws := dialWS(t, wsServer(t), "/ws/echo")
+
+	// A ping may arrive between the fragments of a message.
+	ws.c.Write(rawFrame(false, true, opText, []byte("hel")))
+	ws.c.Write(rawFrame(true, true, opPing, []byte("p")))
+	ws.c.Write(rawFrame(false, true, opContinuation, []byte("lo ")))
+	ws.c.Write(rawFrame(true, true, opContinuation, []byte("wörld")))
+
+	f, err := ws.readFrame()
+	if err != nil || f.op != opPong || string(f.payload) != "p" {
+		t.Fatalf("Got %+v, %v, want pong", f, err)
+	}
+	op, data, err := ws.readMessage()
+	if err != nil || op != opText || string(data) != "hello wörld" {
+		t.Errorf("Got %d %q %v", op, data, err)
+	}
+
+	// A long binary message takes the 16 bit length.
+	long := make([]byte, 1000)
+	ws.writeFrame(opBinary, long)
+	if op, data, err := ws.readMessage(); err != nil || op != opBinary || len(data) != 1000 {
+		t.Errorf("Got %d, %d bytes, %v", op, len(data), err)
+	}
+
+	ws.close(closeNormal, "bye")
+	f, err = ws.readFrame()
+	if err != nil || f.op != opClose || binary.BigEndian.Uint16(f.payload) != closeNormal {
+		t.Errorf("Got %+v, %v, want close 1000", f, err)
+	}
+}
+
+func TestWSCloseCodes(t *testing.T) {
+	addr := wsServer(t)
+	testcases := []struct {
+		name  string
+		frame []byte
+		code  int
+	}{
+		{"unmasked", rawFrame(true, false, opText, []byte("x")), closeProtocolError},
+		{"bad utf-8", rawFrame(true, true, opText, []byte{0xff, 0xfe}), closeInvalidData},
+		{"stray continuation", rawFrame(true, true, opContinuation, []byte("x")), closeProtocolError},
+		{"unknown opcode", rawFrame(true, true, 0x3, nil), closeProtocolError},
+		{"fragmented ping", rawFrame(false, true, opPing, nil), closeProtocolError},
+		{"reserved code", rawFrame(true, true, opClose, []byte{0x03, 0xE7}), closeProtocolError},
+		{"empty close", rawFrame(true, true, opClose, nil), closeNormal},
+		{"app close", rawFrame(true, true, opClose, []byte{0x0F, 0xA0, 'o', 'k'}), 4000},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ws := dialWS(t, addr, "/ws/echo")
+			ws.c.Write(tc.frame)
+			f, err := ws.readFrame()
+			if err != nil || f.op != opClose || len(f.payload) < 2 {
+				t.Fatalf("Got %+v, %v, want a close frame", f, err)
+			}
+			if got := int(binary.BigEndian.Uint16(f.payload)); got != tc.code {
+				t.Errorf("Close code %d, want %d", got, tc.code)
+			}
+		})
+	}
+}
+
+func TestWSBroadcast(t *testing.T) {
+	addr := wsServer(t)
+	a := dialWS(t, addr, "/ws/broadcast")
+	b := dialWS(t, addr, "/ws/broadcast")
+
+	// Wait until both have joined, an echo round trip on each proves
+	// its read loop is running.
+	for _, ws := range []*wsConn{a, b} {
+		ws.writeFrame(opText, []byte("hi"))
+		for {
+			_, data, err := ws.readMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) == "hi" {
+				break
+			}
+		}
+	}
+	// a may still see b's hi
+	a.writeFrame(opText, []byte("news"))
+	for name, ws := range map[string]*wsConn{"a": a, "b": b} {
+		for {
+			_, data, err := ws.readMessage()
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if string(data) == "news" {
+				break
+			}
+		}
+	}
+}
+
+func TestWSHandshakeErrors(t *testing.T) {
+	s := &server{def: &site{root: t.TempDir()}, wsPrefix: "/ws/", room: newWSRoom()}
+	testcases := []struct {
+		name   string
+		fields string
+		status string
+		header string
+	}{
+		{"plain GET", "", "426 Upgrade Required", "Upgrade"},
+		{"old version", "Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 8\r\n" +
+			"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n", "426 Upgrade Required", "Sec-WebSocket-Version"},
+		{"bad key", "Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 13\r\n" +
+			"Sec-WebSocket-Key: short\r\n", "400 Bad Request", ""},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := roundTrip(t, s, "GET /ws/echo HTTP/1.1\r\nHost: test\r\n"+tc.fields+"\r\n")
+			if got := firstLine(resp); got != "HTTP/1.1 "+tc.status {
+				t.Errorf("Got %q, want %q", got, tc.status)
+			}
+			if tc.header != "" && headerValue(resp, tc.header) == "" {
+				t.Errorf("Missing %s in %q", tc.header, resp)
+			}
+		})
+	}
+	if resp := roundTrip(t, s, "GET /ws/other HTTP/1.1\r\nHost: test\r\n\r\n"); !strings.HasPrefix(resp, "HTTP/1.1 404 ") {
+		t.Errorf("Unknown demo got %q", firstLine(resp))
+	}
+}
+
+func TestWSBehindAuth(t *testing.T) {
+	users, err := loadHtpasswd(testHtpasswd(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server{
+		def:      &site{root: t.TempDir(), auth: []authRule{{prefix: "/", realm: "site", users: users}}},
+		wsPrefix: "/ws/",
+		room:     newWSRoom(),
+	}
+	upgrade := "Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 13\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"
+	alice := "Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte("alice:hunter2")) + "\r\n"
+
+	testcases := []struct {
+		name   string
+		raw    string
+		status string
+	}{
+		{"anonymous", "GET /ws/echo HTTP/1.1\r\nHost: test\r\n" + upgrade + "\r\n", "401 Unauthorized"},
+		{"no host", "GET /ws/broadcast HTTP/1.1\r\n" + alice + upgrade + "\r\n", "400 Bad Request"},
+		{"authorized", "GET /ws/echo HTTP/1.1\r\nHost: test\r\n" + alice + upgrade + "\r\n", "101 Switching Protocols"},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := firstLine(roundTrip(t, s, tc.raw)); got != "HTTP/1.1 "+tc.status {
+				t.Errorf("Got %q, want %q", got, tc.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Largest message the demos accept, fragments joined.
+const wsMaxMessage = 1 << 20
+
+// serveWebSocket runs the demo under the WebSocket prefix: "echo"
+// sends every message back, "broadcast" sends it to every connected
+// broadcast client, the sender included.
+func (s *server) serveWebSocket(c net.Conn, b *bytes.Buffer, req *request) {
+	demo := strings.TrimPrefix(req.path, s.wsPrefix)
+	if demo != "echo" && demo != "broadcast" {
+		sendError(b, "404 File not found")
+		return
+	}
+	ws := upgrade(c, b, req)
+	if ws == nil {
+		return
+	}
+
+	if demo == "echo" {
+		for {
+			op, data, err := ws.readMessage()
+			if err != nil {
+				return
+			}
+			if err := ws.writeFrame(op, data); err != nil {
+				return
+			}
+		}
+	}
+
+	s.room.join(ws)
+	defer s.room.leave(ws)
+	for {
+		op, data, err := ws.readMessage()
+		if err != nil {
+			return
+		}
+		s.room.send(op, data)
+	}
+}
+
+// upgrade completes the opening handshake (RFC 6455, 4.2) and returns
+// the connection ready for frames, or nil after answering an error.
+func upgrade(c net.Conn, b *bytes.Buffer, req *request) *wsConn {
+	if !headerHasToken(req.header["Upgrade"], "websocket") ||
+		!headerHasToken(req.header["Connection"], "upgrade") {
+		status := "426 Upgrade Required"
+		buildResp(b, status, "text/plain", strconv.Itoa(len(status)), "Upgrade: websocket")
+		b.WriteString(status)
+		return nil
+	}
+	if req.header["Sec-Websocket-Version"] != "13" {
+		status := "426 Upgrade Required"
+		buildResp(b, status, "text/plain", strconv.Itoa(len(status)),
+			"Upgrade: websocket", "Sec-WebSocket-Version: 13")
+		b.WriteString(status)
+		return nil
+	}
+	key := req.header["Sec-Websocket-Key"]
+	if nonce, err := base64.StdEncoding.DecodeString(key); err != nil || len(nonce) != 16 {
+		sendError(b, "400 Bad Request")
+		return nil
+	}
+
+	_, err := c.Write([]byte("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + wsAccept(key) + "\r\n\r\n"))
+	if err != nil {
+		return nil
+	}
+	// Frames the client sent right behind its request are buffered in
+	// the request body already.
+	return &wsConn{c: c, r: bufio.NewReader(req.body), maxMessage: wsMaxMessage}
+}
+
+// headerHasToken reports whether a comma separated header value lists
+// token, ignoring case.
+func headerHasToken(value, token string) bool {
+	for _, t := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(t), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// wsRoom is the set of clients of the broadcast demo.
+type wsRoom struct {
+	mu      sync.Mutex
+	members map[*wsConn]bool
+}
+
+func newWSRoom() *wsRoom {
+	return &wsRoom{members: make(map[*wsConn]bool)}
+}
+
+func (r *wsRoom) join(ws *wsConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.members[ws] = true
+}
+
+func (r *wsRoom) leave(ws *wsConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.members, ws)
+}
+
+// send writes a message to every member. A member that can't take it
+// within a few seconds is dropped rather than holding up the rest.
+func (r *wsRoom) send(op byte, data []byte) {
+	r.mu.Lock()
+	members := make([]*wsConn, 0, len(r.members))
+	for ws := range r.members {
+		members = append(members, ws)
+	}
+	r.mu.Unlock()
+
+	for _, ws := range members {
+		ws.c.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		if err := ws.writeFrame(op, data); err != nil {
+			log.Printf("Broadcast to %v: %v", ws.c.RemoteAddr(), err)
+			ws.c.Close()
+			r.leave(ws)
+		}
+	}
+}
@@ -1,37 +1,245 @@
 package main
 
 import (
-	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"os"
 	"time"
 )
 
-const (
-	host = "time.nist.gov"
-	port = "37"
-)
-
-const nistUnixOffset int64 = 2208988800 // Jan 1, 1900 to Jan 1, 1970.
+// timeClient asks an RFC 868 Time Protocol server, or an SNTP one,
+// for the time.
+type timeClient struct {
+	addr    string
+	udp     bool
+	sntp    bool          // SNTP (RFC 4330), always over UDP
+	timeout time.Duration // for each attempt; over UDP doubled on each retransmission
+	retries int           // further attempts after a failed one
+	wait    time.Duration // pause between TCP attempts
+}
 
 func main() {
-	addr := net.JoinHostPort(host, port)
-	conn, err := net.Dial("tcp", addr)
+	host := flag.String("host", "time.nist.gov", "time server to ask")
+	port := flag.String("port", "37", "port of the time server")
+	timeout := flag.Duration("timeout", 5*time.Second, "give up on an attempt after this long")
+	retries := flag.Int("retries", 2, "attempts to make after a failed one")
+	udp := flag.Bool("udp", false, "ask over UDP, retransmitting with backoff, instead of TCP")
+	sntp := flag.Bool("sntp", false, "ask an SNTP server (RFC 4330), on port 123 unless -port says otherwise")
+	asJSON := flag.Bool("json", false, "print the result as JSON")
+	flag.Parse()
+
+	if *sntp {
+		portSet := false
+		flag.Visit(func(f *flag.Flag) { portSet = portSet || f.Name == "port" })
+		if !portSet {
+			*port = "123"
+		}
+	}
+
+	tc := &timeClient{
+		addr:    net.JoinHostPort(*host, *port),
+		udp:     *udp,
+		sntp:    *sntp,
+		timeout: *timeout,
+		retries: *retries,
+		// NIST refuses clients asking more than once every 4 seconds.
+		wait: 4 * time.Second,
+	}
+	m, err := tc.query()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *asJSON {
+		err = writeJSON(os.Stdout, m)
+	} else {
+		err = writeReport(os.Stdout, m)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// query asks the server for the time, retrying failed attempts.
+// TCP attempts are spaced by tc.wait. Over UDP a lost datagram is
+// retransmitted right away, the wait for its answer doubling each
+// time so as not to add to whatever congestion lost it. An SNTP
+// server's kiss-o'-death ends the asking.
+func (tc *timeClient) query() (measurement, error) {
+	var err error
+	timeout := tc.timeout
+	for attempt := 0; attempt <= tc.retries; attempt++ {
+		var m measurement
+		if tc.udp || tc.sntp {
+			if attempt > 0 {
+				timeout *= 2
+				log.Printf("Attempt %d failed: %v; retransmitting, waiting %v", attempt, err, timeout)
+			}
+			if tc.sntp {
+				m, err = tc.querySNTP(timeout)
+			} else {
+				m, err = tc.queryUDP(timeout)
+			}
+		} else {
+			if attempt > 0 {
+				log.Printf("Attempt %d failed: %v; retrying in %v", attempt, err, tc.wait)
+				time.Sleep(tc.wait)
+			}
+			m, err = tc.queryTCP(timeout)
+		}
+		if err == nil {
+			if m.ntp == nil {
+				m.serverTime = rfc868Time(m.raw)
+			}
+			return m, nil
+		}
+		if errors.As(err, new(kissOfDeath)) {
+			break
+		}
+	}
+	return measurement{}, fmt.Errorf("asking %s for the time: %w", tc.addr, err)
+}
+
+// queryTCP connects and reads the 4 byte answer the server sends
+// before closing (RFC 868, TCP).
+func (tc *timeClient) queryTCP(timeout time.Duration) (measurement, error) {
+	m := measurement{server: tc.addr, network: "tcp", sent: time.Now()}
+	deadline := m.sent.Add(timeout)
+	d := net.Dialer{Deadline: deadline}
+	conn, err := d.Dial("tcp", tc.addr)
 	if err != nil {
-		log.Fatalf("Error connecting: %v", err)
+		return m, err
 	}
 	defer conn.Close()
+	conn.SetDeadline(deadline)
 
-	unixSeconds := time.Now().Unix() + nistUnixOffset
+	// Read one byte more than there should be, to catch a long answer.
+	answer, err := io.ReadAll(io.LimitReader(conn, 5))
+	if err != nil {
+		return m, fmt.Errorf("reading the time: %w", err)
+	}
+	m.received = time.Now()
+	m.raw, err = decodeAnswer(answer)
+	return m, err
+}
+
+// queryUDP sends an empty datagram and waits for the answer (RFC 868,
+// UDP).
+func (tc *timeClient) queryUDP(timeout time.Duration) (measurement, error) {
+	m, answer, err := tc.exchangeUDP(timeout, func(time.Time) []byte { return nil })
+	if err != nil {
+		return m, err
+	}
+	m.raw, err = decodeAnswer(answer)
+	return m, err
+}
 
-	var rawSeconds uint32
-	err = binary.Read(conn, binary.BigEndian, &rawSeconds)
+// exchangeUDP sends the server the datagram request makes, given the
+// time it goes out, and waits for the answer. Each attempt uses a
+// fresh socket, so a late answer to an earlier one can't be taken for
+// this one's and skew the delay. Datagrams from anyone but the server
+// are ignored.
+func (tc *timeClient) exchangeUDP(timeout time.Duration, request func(sent time.Time) []byte) (measurement, []byte, error) {
+	m := measurement{server: tc.addr, network: "udp"}
+	server, err := net.ResolveUDPAddr("udp", tc.addr)
 	if err != nil {
-		log.Print("Error reading binary data:", err)
-		return
+		return m, nil, err
 	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return m, nil, err
+	}
+	defer conn.Close()
 
-	fmt.Printf("Unix Timestamp: %d\n", unixSeconds)
-	fmt.Printf("NIST Timestamp: %d\n", rawSeconds)
+	m.sent = time.Now()
+	conn.SetDeadline(m.sent.Add(timeout))
+	if _, err := conn.WriteToUDP(request(m.sent), server); err != nil {
+		return m, nil, err
+	}
+	buf := make([]byte, 512)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return m, nil, fmt.Errorf("reading the time: %w", err)
+		}
+		if !from.IP.Equal(server.IP) || from.Port != server.Port {
+			log.Printf("Ignoring a datagram from %v", from)
+			continue
+		}
+		m.received = time.Now()
+		return m, buf[:n], nil
+	}
+}
+
+func writeReport(w io.Writer, m measurement) error {
+	local := m.received.UTC()
+	serverTime := m.serverTime.Format(time.DateTime + " MST")
+	protocol := ""
+	if m.ntp != nil {
+		serverTime = m.serverTime.Format(time.DateTime + ".000 MST")
+		protocol = fmt.Sprintf(" (SNTP v%d, stratum %d, reference %s)", m.ntp.version(), m.ntp.Stratum, m.ntp.reference())
+	}
+	_, err := fmt.Fprintf(w, "Server:      %s over %s%s\n"+
+		"Server time: %s\n"+
+		"Local time:  %s\n"+
+		"Offset:      %s\n"+
+		"Round trip:  %v\n",
+		m.server, m.network, protocol,
+		serverTime,
+		local.Format(time.DateTime+".000 MST"),
+		describeOffset(m.offset(), m.uncertainty()),
+		m.delay().Round(time.Millisecond))
+	return err
+}
+
+// describeOffset puts an offset in words, from the local clock's side.
+// One within the uncertainty is as good as none.
+func describeOffset(offset, uncertainty time.Duration) string {
+	pm := fmt.Sprintf("(±%v)", uncertainty.Round(10*time.Millisecond))
+	switch {
+	case offset.Abs() <= uncertainty:
+		return "local clock agrees with the server " + pm
+	case offset > 0:
+		return fmt.Sprintf("local clock is %v behind the server %s", offset.Round(10*time.Millisecond), pm)
+	default:
+		return fmt.Sprintf("local clock is %v ahead of the server %s", (-offset).Round(10*time.Millisecond), pm)
+	}
+}
+
+func writeJSON(w io.Writer, m measurement) error {
+	var stratum uint8
+	var reference string
+	if m.ntp != nil {
+		stratum, reference = m.ntp.Stratum, m.ntp.reference()
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(struct {
+		Server      string    `json:"server"`
+		Network     string    `json:"network"`
+		Raw         uint32    `json:"raw,omitempty"`     // RFC 868 only
+		Stratum     uint8     `json:"stratum,omitempty"` // SNTP only
+		Reference   string    `json:"reference,omitempty"`
+		ServerTime  time.Time `json:"server_time"`
+		LocalTime   time.Time `json:"local_time"`
+		Offset      float64   `json:"offset_seconds"` // server minus local
+		Uncertainty float64   `json:"uncertainty_seconds"`
+		Delay       float64   `json:"delay_seconds"`
+	}{
+		Server:      m.server,
+		Network:     m.network,
+		Raw:         m.raw,
+		Stratum:     stratum,
+		Reference:   reference,
+		ServerTime:  m.serverTime,
+		LocalTime:   m.received.UTC().Round(0),
+		Offset:      m.offset().Seconds(),
+		Uncertainty: m.uncertainty().Seconds(),
+		Delay:       m.delay().Seconds(),
+	})
 }
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startTimeServer runs a local RFC 868 server on loopback that hands
+// each connection, numbered from 1, to serve.
+func startTimeServer(t *testing.T, serve func(n int, c net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	var n atomic.Int32
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				serve(int(n.Add(1)), c)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// sendSeconds answers like a real server: 4 bytes, then close.
+func sendSeconds(c net.Conn, seconds uint32) {
+	binary.Write(c, binary.BigEndian, seconds)
+}
+
+func TestQuery(t *testing.T) {
+	const want = 3913056000 // 2024-01-01 00:00:00 UTC
+	testcases := []struct {
+		name    string
+		failFor int // connections closed without an answer
+		hang    bool
+		short   bool
+		long    bool
+		retries int
+		wantErr bool
+	}{
+		{name: "answer", retries: 0},
+		{name: "retried", failFor: 2, retries: 2},
+		{name: "out of retries", failFor: 2, retries: 1, wantErr: true},
+		{name: "short answer", short: true, wantErr: true},
+		{name: "long answer", long: true, wantErr: true},
+		{name: "silent server", hang: true, wantErr: true},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			addr := startTimeServer(t, func(n int, c net.Conn) {
+				switch {
+				case n <= tc.failFor:
+				case tc.short:
+					c.Write([]byte{0xE9, 0x3C})
+				case tc.long:
+					c.Write([]byte{0xE9, 0x3C, 0x00, 0x00, 0x00})
+				case tc.hang:
+					time.Sleep(time.Second)
+				default:
+					sendSeconds(c, want)
+				}
+			})
+			client := &timeClient{addr: addr, timeout: 200 * time.Millisecond, retries: tc.retries}
+			start := time.Now()
+			got, err := client.query()
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("Expected error, got %d", got.raw)
+				}
+				if elapsed := time.Since(start); elapsed > time.Second {
+					t.Errorf("Took %v to give up", elapsed)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if got.raw != want || !got.serverTime.Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)) {
+				t.Errorf("Got %d (%v), want %d", got.raw, got.serverTime, want)
+			}
+			if got.delay() <= 0 || got.delay() > time.Second {
+				t.Errorf("Got delay %v", got.delay())
+			}
+		})
+	}
+}
+
+// startUDPTimeServer runs a local RFC 868 server over UDP that hands
+// each datagram's sender, numbered from 1, to serve.
+func startUDPTimeServer(t *testing.T, serve func(n int, pc net.PacketConn, from net.Addr)) string {
+	t.Helper()
+	return startUDPTimeServerWith(t, func(n int, pc net.PacketConn, from net.Addr, _ []byte) {
+		serve(n, pc, from)
+	})
+}
+
+// startUDPTimeServerWith is startUDPTimeServer for servers that read
+// the datagram too.
+func startUDPTimeServerWith(t *testing.T, serve func(n int, pc net.PacketConn, from net.Addr, req []byte)) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for n := 1; ; n++ {
+			m, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			serve(n, pc, from, buf[:m])
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func TestQueryUDP(t *testing.T) {
+	const want = 3913056000
+	answer := binary.BigEndian.AppendUint32(nil, want)
+	testcases := []struct {
+		name     string
+		drop     int // datagrams left unanswered
+		imposter bool
+		reply    []byte
+		retries  int
+		wantErr  bool
+		minTime  time.Duration
+	}{
+		{name: "answer", reply: answer},
+		// Waits 50ms, then 100ms, then gets an answer.
+		{name: "retransmitted", drop: 2, reply: answer, retries: 2, minTime: 150 * time.Millisecond},
+		{name: "out of retries", drop: 2, reply: answer, retries: 1, wantErr: true, minTime: 150 * time.Millisecond},
+		{name: "imposter ignored", imposter: true, reply: answer},
+		{name: "short answer", reply: answer[:3], wantErr: true},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			addr := startUDPTimeServer(t, func(n int, pc net.PacketConn, from net.Addr) {
+				if n <= tc.drop {
+					return
+				}
+				if tc.imposter {
+					other, err := net.ListenPacket("udp", "127.0.0.1:0")
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					defer other.Close()
+					other.WriteTo(binary.BigEndian.AppendUint32(nil, 1), from)
+					time.Sleep(10 * time.Millisecond)
+				}
+				pc.WriteTo(tc.reply, from)
+			})
+			client := &timeClient{addr: addr, udp: true, timeout: 50 * time.Millisecond, retries: tc.retries}
+			start := time.Now()
+			got, err := client.query()
+			if elapsed := time.Since(start); elapsed < tc.minTime {
+				t.Errorf("Took %v, want at least %v of backoff", elapsed, tc.minTime)
+			}
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("Expected error, got %d", got.raw)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if got.raw != want || got.network != "udp" {
+				t.Errorf("Got %d over %s, want %d over udp", got.raw, got.network, want)
+			}
+		})
+	}
+}
+
+func TestQueryNoServer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	client := &timeClient{addr: addr, timeout: time.Second, retries: 1, wait: 10 * time.Millisecond}
+	if got, err := client.query(); err == nil {
+		t.Errorf("Expected error, got %d", got.raw)
+	}
+}
+
+func TestRFC868Time(t *testing.T) {
+	testcases := []struct {
+		name    string
+		seconds uint32
+		want    time.Time
+	}{
+		{name: "unix epoch", seconds: 2208988800, want: time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{name: "2024", seconds: 3913056000, want: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{name: "last second of the era", seconds: 1<<32 - 1, want: time.Date(2036, 2, 7, 6, 28, 15, 0, time.UTC)},
+		{name: "wrapped to zero", seconds: 0, want: time.Date(2036, 2, 7, 6, 28, 16, 0, time.UTC)},
+		{name: "earliest", seconds: 1 << 31, want: time.Date(1968, 1, 20, 3, 14, 8, 0, time.UTC)},
+		{name: "latest", seconds: 1<<31 - 1, want: time.Date(2104, 2, 26, 9, 42, 23, 0, time.UTC)},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := rfc868Time(tc.seconds); !got.Equal(tc.want) {
+				t.Errorf("Got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestOffset(t *testing.T) {
+	sent := time.Date(2024, 1, 1, 0, 0, 10, 0, time.UTC)
+	testcases := []struct {
+		name   string
+		server time.Time
+		rtt    time.Duration
+		offset time.Duration
+	}{
+		// Answered at 10.1s local, mid-second 10.5s at the server.
+		{name: "in step", server: sent, rtt: 200 * time.Millisecond, offset: 400 * time.Millisecond},
+		{name: "server ahead", server: sent.Add(3 * time.Second), rtt: 0, offset: 3500 * time.Millisecond},
+		{name: "server behind", server: sent.Add(-2 * time.Second), rtt: time.Second, offset: -2 * time.Second},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := measurement{serverTime: tc.server, sent: sent, received: sent.Add(tc.rtt)}
+			if m.delay() != tc.rtt || m.offset() != tc.offset {
+				t.Errorf("Got delay %v offset %v, want %v %v", m.delay(), m.offset(), tc.rtt, tc.offset)
+			}
+			if want := 500*time.Millisecond + tc.rtt/2; m.uncertainty() != want {
+				t.Errorf("Got uncertainty %v, want %v", m.uncertainty(), want)
+			}
+		})
+	}
+}
+
+func TestDescribeOffset(t *testing.T) {
+	for offset, want := range map[time.Duration]string{
+		300 * time.Millisecond: "local clock agrees with the server (±600ms)",
+		-2 * time.Second:       "local clock is 2s ahead of the server (±600ms)",
+		90 * time.Second:       "local clock is 1m30s behind the server (±600ms)",
+	} {
+		if got := describeOffset(offset, 600*time.Millisecond); got != want {
+			t.Errorf("%v: got %q, want %q", offset, got, want)
+		}
+	}
+}
+
+func TestOutput(t *testing.T) {
+	sent := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	m := measurement{
+		server:     "time.example:37",
+		network:    "tcp",
+		raw:        3913056005,
+		serverTime: rfc868Time(3913056005),
+		sent:       sent,
+		received:   sent.Add(40 * time.Millisecond),
+	}
+
+	var b bytes.Buffer
+	writeReport(&b, m)
+	for _, want := range []string{
+		"Server:      time.example:37 over tcp\n",
+		"Server time: 2024-01-01 00:00:05 UTC\n",
+		"Local time:  2024-01-01 00:00:00.040 UTC\n",
+		"Offset:      local clock is 5.48s behind the server (±520ms)\n",
+		"Round trip:  40ms\n",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("Report %q lacks %q", b.String(), want)
+		}
+	}
+
+	b.Reset()
+	writeJSON(&b, m)
+	var got struct {
+		Network    string    `json:"network"`
+		Raw        uint32    `json:"raw"`
+		ServerTime time.Time `json:"server_time"`
+		Offset     float64   `json:"offset_seconds"`
+		Delay      float64   `json:"delay_seconds"`
+	}
+	if err := json.Unmarshal(b.Bytes(), &got); err != nil {
+		t.Fatalf("Decoding %s: %v", b.String(), err)
+	}
+	if got.Network != "tcp" || got.Raw != m.raw || !got.ServerTime.Equal(m.serverTime) || got.Offset != 5.48 || got.Delay != 0.04 {
+		t.Errorf("Got %+v", got)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+const nistUnixOffset int64 = 2208988800 // Jan 1, 1900 to Jan 1, 1970.
+
+// rfc868Time converts the seconds since 1900 a time server sends to a
+// time. The 32-bit count runs out on 2036-02-07 06:28:16 UTC and
+// starts over at zero; counts with the top bit clear, which would be
+// before 1968, are taken to be after that, as NTP does for its era
+// rollover. That places every answer between 1968 and 2104.
+func rfc868Time(seconds uint32) time.Time {
+	s := int64(seconds)
+	if seconds < 1<<31 {
+		s += 1 << 32
+	}
+	return time.Unix(s-nistUnixOffset, 0).UTC()
+}
+
+// decodeAnswer reads the answer both transports carry: the seconds
+// since 1900 as 4 bytes, big-endian.
+func decodeAnswer(b []byte) (uint32, error) {
+	if len(b) != 4 {
+		return 0, fmt.Errorf("answer is %d bytes, want 4", len(b))
+	}
+	return binary.BigEndian.Uint32(b), nil
+}
+
+// Time servers send whole seconds, truncated; the true time at the
+// server was anywhere in the second after.
+const resolution = time.Second
+
+// measurement is one answer from a time server and what it tells
+// about the local clock.
+type measurement struct {
+	server     string
+	network    string // tcp or udp
+	raw        uint32
+	serverTime time.Time  // the second the server reported, or its SNTP transmit time
+	sent       time.Time  // local time before dialing or sending
+	received   time.Time  // local time after reading the answer
+	ntp        *ntpPacket // the answer, for SNTP
+}
+
+// serverTimes are when, by its own clock, the server got the request
+// and when it answered: T2 and T3 of RFC 4330. An RFC 868 server says
+// neither, and is assumed to have done both at once, in the middle of
+// the second it reported.
+func (m measurement) serverTimes() (arrived, answered time.Time) {
+	if m.ntp != nil {
+		return m.ntp.ReceiveTime.time(), m.ntp.TransmitTime.time()
+	}
+	mid := m.serverTime.Add(resolution / 2)
+	return mid, mid
+}
+
+// delay is the round trip, from dialing or sending to having the
+// answer, less the time the server held the request.
+func (m measurement) delay() time.Duration {
+	arrived, answered := m.serverTimes()
+	return m.received.Sub(m.sent) - answered.Sub(arrived)
+}
+
+// offset estimates how far the server's clock is ahead of the local
+// one, negative when behind, assuming the request and the answer took
+// as long as each other: ((T2 - T1) + (T3 - T4)) / 2.
+func (m measurement) offset() time.Duration {
+	arrived, answered := m.serverTimes()
+	return (arrived.Sub(m.sent) + answered.Sub(m.received)) / 2
+}
+
+// uncertainty bounds the error of offset: half the server's
+// resolution, half a second for RFC 868's truncation, plus half the
+// round trip for not knowing how it split between the two ways.
+func (m measurement) uncertainty() time.Duration {
+	res := resolution
+	if m.ntp != nil {
+		res = m.ntp.precision()
+	}
+	return res/2 + m.delay()/2
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"time"
+)
+
+// ntpTime is an NTP timestamp: the seconds since 1900 in the high 32
+// bits, as RFC 868 counts them, and the fraction of a second in the
+// low 32. Zero means the time is unknown.
+type ntpTime uint64
+
+// toNTPTime encodes t, rounding to the nearest 2^-32 s. The seconds
+// wrap in 2036 the same way an RFC 868 server's do.
+func toNTPTime(t time.Time) ntpTime {
+	seconds := uint64(uint32(t.Unix() + nistUnixOffset))
+	fraction := (uint64(t.Nanosecond())<<32 + 5e8) / 1e9
+	return ntpTime(seconds<<32 | fraction)
+}
+
+// time decodes ts, placing it in the era rfc868Time does.
+func (ts ntpTime) time() time.Time {
+	nanos := (uint64(uint32(ts))*1e9 + 1<<31) >> 32
+	return rfc868Time(uint32(ts >> 32)).Add(time.Duration(nanos))
+}
+
+const (
+	ntpVersion = 4
+	modeClient = 3
+	modeServer = 4
+
+	leapAlarm  = 3  // the server's clock is not synchronized
+	maxStratum = 15 // 16 and up mean unsynchronized
+)
+
+// ntpPacket is the 48 byte NTP header (RFC 4330, section 4), in wire
+// order so encoding/binary can read and write it whole. Any extension
+// fields or authenticator after it are ignored.
+type ntpPacket struct {
+	Flags          uint8 // leap indicator, version and mode: LLVVVMMM
+	Stratum        uint8
+	Poll           int8
+	Precision      int8   // log2 of the clock's precision in seconds
+	RootDelay      uint32 // 16.16 fixed point seconds
+	RootDispersion uint32 // likewise
+	ReferenceID    [4]byte
+	ReferenceTime  ntpTime // when the clock was last set
+	OriginTime     ntpTime // the client's transmit time, echoed back
+	ReceiveTime    ntpTime // when the request reached the server
+	TransmitTime   ntpTime // when the answer left it
+}
+
+const ntpPacketSize = 48
+
+func (p *ntpPacket) leap() uint8    { return p.Flags >> 6 }
+func (p *ntpPacket) version() uint8 { return p.Flags >> 3 & 7 }
+func (p *ntpPacket) mode() uint8    { return p.Flags & 7 }
+
+func ntpFlags(leap, version, mode uint8) uint8 {
+	return leap<<6 | version<<3 | mode
+}
+
+func (p *ntpPacket) marshal() []byte {
+	b, _ := binary.Append(make([]byte, 0, ntpPacketSize), binary.BigEndian, p)
+	return b
+}
+
+func parseNTPPacket(b []byte) (ntpPacket, error) {
+	var p ntpPacket
+	if len(b) < ntpPacketSize {
+		return p, fmt.Errorf("answer is %d bytes, want at least %d", len(b), ntpPacketSize)
+	}
+	_, err := binary.Decode(b, binary.BigEndian, &p)
+	return p, err
+}
+
+// precision is the server's clock resolution. Anything coarser than a
+// second is taken to be a second, as good as an RFC 868 answer.
+func (p *ntpPacket) precision() time.Duration {
+	return time.Duration(math.Ldexp(float64(time.Second), min(int(p.Precision), 0)))
+}
+
+// reference names the server's time source: for stratum 1, and kiss
+// codes at stratum 0, up to four ASCII characters such as "GPS" or
+// "NIST"; above that the IPv4 address of the upstream server, or a
+// hash of its IPv6 one.
+func (p *ntpPacket) reference() string {
+	if p.Stratum <= 1 {
+		return string(bytes.TrimRight(p.ReferenceID[:], "\x00"))
+	}
+	return net.IP(p.ReferenceID[:]).String()
+}
+
+// kissOfDeath is a stratum 0 answer: the server telling the client to
+// go away (DENY, RSTR) or ask less often (RATE), not the time.
+type kissOfDeath struct {
+	code string
+}
+
+func (k kissOfDeath) Error() string {
+	return fmt.Sprintf("server sent kiss-o'-death %q; not asking again", k.code)
+}
+
+// checkReply applies the sanity checks of RFC 4330, section 5, to an
+// answer to the request sent with transmit timestamp sent.
+func checkReply(p *ntpPacket, sent ntpTime) error {
+	switch {
+	case p.mode() != modeServer:
+		return fmt.Errorf("answer has mode %d, want %d (server)", p.mode(), modeServer)
+	case p.version() < 1 || p.version() > ntpVersion:
+		return fmt.Errorf("answer has NTP version %d", p.version())
+	case p.OriginTime != sent:
+		// Not an answer to this request: a stale one to an earlier
+		// request, or a forgery.
+		return fmt.Errorf("answer's origin timestamp %#x is not our transmit timestamp %#x", uint64(p.OriginTime), uint64(sent))
+	case p.Stratum == 0:
+		return kissOfDeath{code: p.reference()}
+	case p.leap() == leapAlarm:
+		return fmt.Errorf("server clock is not synchronized (leap indicator %d)", leapAlarm)
+	case p.Stratum > maxStratum:
+		return fmt.Errorf("server is at stratum %d, unsynchronized", p.Stratum)
+	case p.TransmitTime == 0:
+		return fmt.Errorf("answer has no transmit timestamp")
+	}
+	return nil
+}
+
+// querySNTP asks an SNTP server (RFC 4330) for the time. The request
+// carries the local time it was sent at as its transmit timestamp,
+// which the server echoes back as the origin timestamp; that is how
+// the answer is matched to it.
+func (tc *timeClient) querySNTP(timeout time.Duration) (measurement, error) {
+	var request ntpTime
+	m, answer, err := tc.exchangeUDP(timeout, func(sent time.Time) []byte {
+		request = toNTPTime(sent)
+		p := ntpPacket{Flags: ntpFlags(0, ntpVersion, modeClient), TransmitTime: request}
+		return p.marshal()
+	})
+	if err != nil {
+		return m, err
+	}
+	reply, err := parseNTPPacket(answer)
+	if err != nil {
+		return m, err
+	}
+	if err := checkReply(&reply, request); err != nil {
+		return m, err
+	}
+	m.ntp = &reply
+	m.serverTime = reply.TransmitTime.time()
+	return m, nil
+}
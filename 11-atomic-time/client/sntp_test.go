@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNTPTime(t *testing.T) {
+	testcases := []struct {
+		name string
+		t    time.Time
+		want ntpTime
+	}{
+		{name: "unix epoch", t: time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC), want: 2208988800 << 32},
+		{name: "half a second", t: time.Date(2024, 1, 1, 0, 0, 0, 5e8, time.UTC), want: 0xe93c7f00_80000000},
+		{name: "a nanosecond", t: time.Date(2024, 1, 1, 0, 0, 0, 1, time.UTC), want: 0xe93c7f00_00000004},
+		{name: "last of the era", t: time.Date(2036, 2, 7, 6, 28, 15, 999999999, time.UTC), want: 0xffffffff_fffffffc},
+		{name: "wrapped", t: time.Date(2036, 2, 7, 6, 28, 16, 25e7, time.UTC), want: 0x00000000_40000000},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := toNTPTime(tc.t); got != tc.want {
+				t.Errorf("Got %#x, want %#x", uint64(got), uint64(tc.want))
+			}
+			if got := tc.want.time(); !got.Equal(tc.t) {
+				t.Errorf("Got %v, want %v", got, tc.t)
+			}
+		})
+	}
+}
+
+func TestNTPPacket(t *testing.T) {
+	p := ntpPacket{
+		Flags:        ntpFlags(0, ntpVersion, modeClient),
+		Stratum:      2,
+		Precision:    -20,
+		ReferenceID:  [4]byte{192, 0, 2, 1},
+		TransmitTime: 0x0102030405060708,
+	}
+	b := p.marshal()
+	if len(b) != ntpPacketSize || b[0] != 0x23 || b[1] != 2 || b[3] != 0xec || !bytes.Equal(b[40:], []byte{1, 2, 3, 4, 5, 6, 7, 8}) {
+		t.Fatalf("Got % x", b)
+	}
+
+	got, err := parseNTPPacket(append(b, "extension fields"...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != p || got.leap() != 0 || got.version() != 4 || got.mode() != 3 || got.reference() != "192.0.2.1" {
+		t.Errorf("Got %+v, want %+v", got, p)
+	}
+	if got.precision() != 953*time.Nanosecond {
+		t.Errorf("Got precision %v, want 953ns", got.precision())
+	}
+
+	if _, err := parseNTPPacket(b[:47]); err == nil {
+		t.Error("Expected error for a 47 byte packet")
+	}
+}
+
+func FuzzParseNTPPacket(f *testing.F) {
+	f.Add(make([]byte, ntpPacketSize))
+	f.Add((&ntpPacket{Flags: 0x24, Stratum: 1, ReferenceID: [4]byte{'G', 'P', 'S'}, TransmitTime: 1}).marshal())
+	f.Fuzz(func(t *testing.T, b []byte) {
+		p, err := parseNTPPacket(b)
+		if err != nil {
+			if len(b) >= ntpPacketSize {
+				t.Fatalf("Failed on %d bytes: %v", len(b), err)
+			}
+			return
+		}
+		if again := p.marshal(); !bytes.Equal(again, b[:ntpPacketSize]) {
+			t.Fatalf("Round trip of % x gave % x", b[:ntpPacketSize], again)
+		}
+	})
+}
+
+// sntpAnswer is what a healthy stratum 1 server would answer req with.
+func sntpAnswer(req ntpPacket, received, sent time.Time) ntpPacket {
+	return ntpPacket{
+		Flags:        ntpFlags(0, ntpVersion, modeServer),
+		Stratum:      1,
+		Precision:    -20,
+		ReferenceID:  [4]byte{'T', 'E', 'S', 'T'},
+		OriginTime:   req.TransmitTime,
+		ReceiveTime:  toNTPTime(received),
+		TransmitTime: toNTPTime(sent),
+	}
+}
+
+func TestCheckReply(t *testing.T) {
+	sent := toNTPTime(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	now := time.Date(2024, 1, 1, 0, 0, 1, 0, time.UTC)
+	testcases := []struct {
+		name    string
+		change  func(p *ntpPacket)
+		wantErr bool
+	}{
+		{name: "good", change: func(p *ntpPacket) {}},
+		{name: "version 3", change: func(p *ntpPacket) { p.Flags = ntpFlags(0, 3, modeServer) }},
+		{name: "leap second coming", change: func(p *ntpPacket) { p.Flags = ntpFlags(1, ntpVersion, modeServer) }},
+		{name: "stratum 15", change: func(p *ntpPacket) { p.Stratum = 15 }},
+		{name: "alarm", change: func(p *ntpPacket) { p.Flags = ntpFlags(leapAlarm, ntpVersion, modeServer) }, wantErr: true},
+		{name: "client mode", change: func(p *ntpPacket) { p.Flags = ntpFlags(0, ntpVersion, modeClient) }, wantErr: true},
+		{name: "broadcast mode", change: func(p *ntpPacket) { p.Flags = ntpFlags(0, ntpVersion, 5) }, wantErr: true},
+		{name: "version 0", change: func(p *ntpPacket) { p.Flags = ntpFlags(0, 0, modeServer) }, wantErr: true},
+		{name: "version 5", change: func(p *ntpPacket) { p.Flags = ntpFlags(0, 5, modeServer) }, wantErr: true},
+		{name: "unsynchronized stratum", change: func(p *ntpPacket) { p.Stratum = 16 }, wantErr: true},
+		{name: "stale origin", change: func(p *ntpPacket) { p.OriginTime-- }, wantErr: true},
+		{name: "no origin", change: func(p *ntpPacket) { p.OriginTime = 0 }, wantErr: true},
+		{name: "no transmit time", change: func(p *ntpPacket) { p.TransmitTime = 0 }, wantErr: true},
+		{name: "kiss-o'-death", change: func(p *ntpPacket) { p.Stratum = 0 }, wantErr: true},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := sntpAnswer(ntpPacket{TransmitTime: sent}, now, now)
+			tc.change(&p)
+			err := checkReply(&p, sent)
+			if tc.wantErr != (err != nil) {
+				t.Errorf("Got %v, want error %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+// startSNTPServer runs a local stand-in for an SNTP server whose clock
+// is skew ahead of the local one. It takes hold to answer, and hands
+// each request, numbered from 1, and the answer it would send to
+// answer, which may change it or return false to send nothing.
+func startSNTPServer(t *testing.T, skew, hold time.Duration, answer func(n int, p *ntpPacket) bool) string {
+	t.Helper()
+	return startUDPTimeServerWith(t, func(n int, pc net.PacketConn, from net.Addr, req []byte) {
+		received := time.Now().Add(skew)
+		p, err := parseNTPPacket(req)
+		if err != nil {
+			t.Errorf("Request %d: %v", n, err)
+			return
+		}
+		if p.mode() != modeClient || p.version() != ntpVersion || p.TransmitTime == 0 {
+			t.Errorf("Request %d is %+v, want a version %d client request with a transmit time", n, p, ntpVersion)
+		}
+		time.Sleep(hold)
+		reply := sntpAnswer(p, received, time.Now().Add(skew))
+		if answer(n, &reply) {
+			pc.WriteTo(reply.marshal(), from)
+		}
+	})
+}
+
+func TestQuerySNTP(t *testing.T) {
+	const skew = -1500 * time.Millisecond
+	const hold = 30 * time.Millisecond
+	testcases := []struct {
+		name     string
+		answer   func(n int, p *ntpPacket) bool
+		retries  int
+		wantErr  bool
+		kiss     bool // a kiss-o'-death, not retried
+		requests int32
+	}{
+		{name: "answer", answer: func(int, *ntpPacket) bool { return true }, requests: 1},
+		{
+			name: "stale answer retried", retries: 1, requests: 2,
+			answer: func(n int, p *ntpPacket) bool {
+				if n == 1 {
+					p.OriginTime++
+				}
+				return true
+			},
+		},
+		{
+			name: "lost answer retransmitted", retries: 1, requests: 2,
+			answer: func(n int, p *ntpPacket) bool { return n > 1 },
+		},
+		{
+			name: "unsynchronized", retries: 1, requests: 2, wantErr: true,
+			answer: func(n int, p *ntpPacket) bool {
+				p.Flags = ntpFlags(leapAlarm, ntpVersion, modeServer)
+				return true
+			},
+		},
+		{
+			name: "kiss-o'-death", retries: 2, requests: 1, wantErr: true, kiss: true,
+			answer: func(n int, p *ntpPacket) bool {
+				p.Stratum, p.ReferenceID = 0, [4]byte{'R', 'A', 'T', 'E'}
+				return true
+			},
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var requests atomic.Int32
+			addr := startSNTPServer(t, skew, hold, func(n int, p *ntpPacket) bool {
+				requests.Add(1)
+				return tc.answer(n, p)
+			})
+			client := &timeClient{addr: addr, sntp: true, timeout: 200 * time.Millisecond, retries: tc.retries}
+			got, err := client.query()
+			if n := requests.Load(); n != tc.requests {
+				t.Errorf("Server got %d requests, want %d", n, tc.requests)
+			}
+			if tc.wantErr {
+				var kod kissOfDeath
+				if err == nil || tc.kiss && (!errors.As(err, &kod) || kod.code != "RATE") {
+					t.Fatalf("Got error %v, want kiss-o'-death %v", err, tc.kiss)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			// The time the server held the request is not delay, and
+			// the offset is right to within half the round trip.
+			if got.delay() >= hold || got.received.Sub(got.sent) < hold {
+				t.Errorf("Got delay %v of a %v round trip, want the %v hold taken out", got.delay(), got.received.Sub(got.sent), hold)
+			}
+			if off := got.offset() - skew; off.Abs() > got.uncertainty() {
+				t.Errorf("Got offset %v, want %v ± %v", got.offset(), skew, got.uncertainty())
+			}
+			if got.ntp.reference() != "TEST" || !got.serverTime.Equal(got.ntp.TransmitTime.time()) {
+				t.Errorf("Got %+v from %v", got.ntp, got.serverTime)
+			}
+		})
+	}
+}
+
+func TestSNTPOffset(t *testing.T) {
+	// The example of RFC 4330, section 5, in milliseconds from t1.
+	t1 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(ms int) time.Time { return t1.Add(time.Duration(ms) * time.Millisecond) }
+	reply := sntpAnswer(ntpPacket{}, at(1100), at(1150)) // server 1s ahead, 50ms to answer
+	m := measurement{sent: t1, received: at(250), ntp: &reply}
+	// Out 100ms, back 100ms: offset ((1100 - 0) + (1150 - 250)) / 2.
+	if m.delay() != 200*time.Millisecond || m.offset() != time.Second {
+		t.Errorf("Got delay %v offset %v, want 200ms 1s", m.delay(), m.offset())
+	}
+	if want := 100*time.Millisecond + 476*time.Nanosecond; m.uncertainty() != want {
+		t.Errorf("Got uncertainty %v, want %v", m.uncertainty(), want)
+	}
+}
+
+func TestSNTPOutput(t *testing.T) {
+	sent := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	reply := sntpAnswer(ntpPacket{}, sent.Add(2020*time.Millisecond), sent.Add(2021*time.Millisecond))
+	m := measurement{server: "time.example:123", network: "udp", serverTime: reply.TransmitTime.time(), sent: sent, received: sent.Add(41 * time.Millisecond), ntp: &reply}
+
+	var b bytes.Buffer
+	writeReport(&b, m)
+	for _, want := range []string{
+		"Server:      time.example:123 over udp (SNTP v4, stratum 1, reference TEST)\n",
+		"Server time: 2024-01-01 00:00:02.021 UTC\n",
+		"Offset:      local clock is 2s behind the server (±20ms)\n",
+		"Round trip:  40ms\n",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("Report %q lacks %q", b.String(), want)
+		}
+	}
+
+	b.Reset()
+	writeJSON(&b, m)
+	var got map[string]any
+	if err := json.Unmarshal(b.Bytes(), &got); err != nil {
+		t.Fatalf("Decoding %s: %v", b.String(), err)
+	}
+	if _, ok := got["raw"]; ok || got["stratum"] != 1.0 || got["reference"] != "TEST" || got["offset_seconds"] != 2.0 {
+		t.Errorf("Got %v", got)
+	}
+}
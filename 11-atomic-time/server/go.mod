@@ -0,0 +1,3 @@
+module ukiran.com/atomic-server
+
+go 1.25.6
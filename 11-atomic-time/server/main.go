@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"time"
+)
+
+const nistUnixOffset int64 = 2208988800 // Jan 1, 1900 to Jan 1, 1970.
+
+// rfc868Seconds encodes t as the seconds since 1900 a time server
+// sends. The 32 bits run out on 2036-02-07 06:28:16 UTC and the count
+// starts over at zero, which clients take to be the next era.
+func rfc868Seconds(t time.Time) uint32 {
+	return uint32(t.Unix() + nistUnixOffset) // wraps modulo 2^32
+}
+
+// timeServer answers with the time of its clock, which tests replace.
+type timeServer struct {
+	now func() time.Time
+}
+
+func main() {
+	port := flag.String("port", "37", "port to serve on, over TCP and UDP; below 1024 needs root")
+	skew := flag.Duration("skew", 0, "answer with a clock this far ahead, or behind if negative, to test clients")
+	flag.Parse()
+
+	s := &timeServer{now: func() time.Time { return time.Now().Add(*skew) }}
+
+	listener, err := net.Listen("tcp", ":"+*port)
+	if err != nil {
+		log.Fatalf("Error listening: %v", err)
+	}
+	pc, err := net.ListenPacket("udp", ":"+*port)
+	if err != nil {
+		log.Fatalf("Error listening: %v", err)
+	}
+	log.Printf("Serving the time on port %s, TCP and UDP", *port)
+
+	go func() {
+		log.Fatal(s.serveUDP(pc))
+	}()
+	log.Fatal(s.serveTCP(listener))
+}
+
+// serveTCP sends each connection the time and closes it (RFC 868).
+func (s *timeServer) serveTCP(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		go s.handleConn(conn)
+	}
+}
+
+func (s *timeServer) handleConn(c net.Conn) {
+	defer c.Close()
+	c.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	seconds := rfc868Seconds(s.now())
+	if err := binary.Write(c, binary.BigEndian, seconds); err != nil {
+		log.Printf("Failed to send the time to %v: %v", c.RemoteAddr(), err)
+		return
+	}
+	log.Printf("Sent %d to %v (tcp)", seconds, c.RemoteAddr())
+}
+
+// serveUDP answers any datagram, whatever it holds, with a datagram
+// holding the time (RFC 868).
+func (s *timeServer) serveUDP(pc net.PacketConn) error {
+	buf := make([]byte, 512)
+	for {
+		_, addr, err := pc.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		seconds := rfc868Seconds(s.now())
+		if _, err := pc.WriteTo(binary.BigEndian.AppendUint32(nil, seconds), addr); err != nil {
+			log.Printf("Failed to send the time to %v: %v", addr, err)
+			continue
+		}
+		log.Printf("Sent %d to %v (udp)", seconds, addr)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRFC868Seconds(t *testing.T) {
+	testcases := []struct {
+		name string
+		t    time.Time
+		want uint32
+	}{
+		{name: "1900 epoch", t: time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC), want: 0},
+		{name: "unix epoch", t: time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC), want: 2208988800},
+		{name: "2024", t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), want: 3913056000},
+		{name: "other zone", t: time.Date(2024, 1, 1, 1, 0, 0, 0, time.FixedZone("CET", 3600)), want: 3913056000},
+		{name: "before 2036 wrap", t: time.Date(2036, 2, 7, 6, 28, 15, 0, time.UTC), want: 1<<32 - 1},
+		{name: "2036 wrap", t: time.Date(2036, 2, 7, 6, 28, 16, 0, time.UTC), want: 0},
+		{name: "after 2036 wrap", t: time.Date(2036, 2, 7, 6, 28, 17, 999, time.UTC), want: 1},
+		{name: "2040", t: time.Date(2040, 1, 1, 0, 0, 0, 0, time.UTC), want: 2*2208988800 - 1<<32}, // 70 years past 1970 as 1970 is past 1900
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := rfc868Seconds(tc.t); got != tc.want {
+				t.Errorf("Got %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+// fixedClock returns a server whose clock is stopped at t.
+func fixedClock(t time.Time) *timeServer {
+	return &timeServer{now: func() time.Time { return t }}
+}
+
+func TestServeTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go fixedClock(time.Date(2036, 2, 7, 6, 28, 20, 0, time.UTC)).serveTCP(ln)
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(2 * time.Second))
+	data, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 4 || binary.BigEndian.Uint32(data) != 4 {
+		t.Errorf("Got %v, want 4 bytes holding 4, then close", data)
+	}
+}
+
+func TestServeUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go fixedClock(time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC)).serveUDP(pc)
+
+	c, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// Any datagram gets an answer, an empty one too.
+	for _, ask := range [][]byte{{}, []byte("what time is it?")} {
+		c.SetDeadline(time.Now().Add(2 * time.Second))
+		if _, err := c.Write(ask); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 16)
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 4 || binary.BigEndian.Uint32(buf) != 2208988800 {
+			t.Errorf("Asked with %q, got %v", ask, buf[:n])
+		}
+	}
+}
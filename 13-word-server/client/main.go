@@ -38,9 +38,11 @@ func extractWord(packet []byte) string {
 	return string(packet[wordLenSize:])
 }
 
-func getNextWordPacket(c net.Conn) ([]byte, error) {
+// getNextWordPacket reads one length-prefixed word packet from r. The
+// packet is returned whole, length bytes included.
+func getNextWordPacket(r io.Reader) ([]byte, error) {
 	lenBuf := make([]byte, wordLenSize)
-	if _, err := io.ReadFull(c, lenBuf); err != nil {
+	if _, err := io.ReadFull(r, lenBuf); err != nil {
 		if err == io.EOF {
 			return nil, err
 		}
@@ -49,7 +51,7 @@ func getNextWordPacket(c net.Conn) ([]byte, error) {
 	wlen := binary.BigEndian.Uint16(lenBuf)
 
 	wordBuf := make([]byte, wlen) // to read exactly 'wlen' bytes
-	if _, err := io.ReadFull(c, wordBuf); err != nil {
+	if _, err := io.ReadFull(r, wordBuf); err != nil {
 		return nil, fmt.Errorf("failed to read payload: %w", err)
 	}
 
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+func FuzzGetNextWordPacket(f *testing.F) {
+	f.Add([]byte{0, 5, 'h', 'e', 'l', 'l', 'o', 0, 2, 'h', 'i'})
+	f.Add([]byte{0, 0})
+	f.Add([]byte{0})
+	f.Add([]byte{0, 9, 's', 'h', 'o', 'r', 't'})
+	f.Add([]byte{0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, stream []byte) {
+		r := bytes.NewReader(stream)
+		var again bytes.Buffer
+		for {
+			packet, err := getNextWordPacket(r)
+			if err != nil {
+				if len(packet) != 0 {
+					t.Fatalf("Got %d bytes with error %v", len(packet), err)
+				}
+				if errors.Is(err, io.EOF) && r.Len() != 0 {
+					t.Fatalf("EOF with %d bytes unread", r.Len())
+				}
+				break
+			}
+			if len(packet) < wordLenSize {
+				t.Fatalf("Packet %x shorter than its length prefix", packet)
+			}
+			if n := binary.BigEndian.Uint16(packet); int(n) != len(packet)-wordLenSize {
+				t.Fatalf("Prefix says %d, word is %d bytes", n, len(packet)-wordLenSize)
+			}
+			if word := extractWord(packet); len(word) != len(packet)-wordLenSize {
+				t.Fatalf("Word %q from packet %x", word, packet)
+			}
+			again.Write(packet)
+		}
+		// Writing the packets back out gives the stream they came from.
+		if !bytes.HasPrefix(stream, again.Bytes()) {
+			t.Fatalf("Packets %x don't rebuild stream %x", again.Bytes(), stream)
+		}
+	})
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func FuzzIpAddrToBytes(f *testing.F) {
+	for _, seed := range []string{
+		"192.168.0.1", "0.0.0.0", "255.255.255.255", "256.1.1.1",
+		"1.2.3", "1.2.3.4.5", "01.02.03.04", "+1.-0.3.4", "", "...",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, addr string) {
+		b, err := ipAddrToBytes(addr)
+		if err != nil {
+			return
+		}
+		if len(b) != 4 {
+			t.Fatalf("%q gave %d bytes", addr, len(b))
+		}
+		// Printed back in dotted decimal it parses to the same bytes.
+		again := fmt.Sprintf("%d.%d.%d.%d", b[0], b[1], b[2], b[3])
+		b2, err := ipAddrToBytes(again)
+		if err != nil || string(b2) != string(b) {
+			t.Fatalf("%q -> %v -> %q -> %v, %v", addr, b, again, b2, err)
+		}
+	})
+}
@@ -137,3 +137,22 @@ func TestFindRouterForIP(t *testing.T) {
 		})
 	}
 }
+
+func FuzzIpv4ToValue(f *testing.F) {
+	for _, seed := range []string{
+		"1.2.3.4", "255.255.0.0", "0.0.0.0", "256.0.0.1", "1.2.3",
+		"1..2.3", "01.2.3.4", "-1.2.3.4", "",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, addr string) {
+		value, err := Ipv4ToValue(addr)
+		if err != nil {
+			return
+		}
+		again := ValueToIpv4(value)
+		if v2, err := Ipv4ToValue(again); err != nil || v2 != value {
+			t.Fatalf("%q -> %d -> %q -> %d, %v", addr, value, again, v2, err)
+		}
+	})
+}